@@ -1,6 +1,7 @@
 package client
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"gorpc/codec"
 	"gorpc/server"
@@ -22,6 +23,8 @@ type Call struct {
 	ServiceMethod string
 	Args interface{}
 	Reply interface{}
+	Version string // version constraint of the service, empty for any
+	Metadata map[string]string // request metadata sent in the header
 	Error error
 	Done chan * Call
 }
@@ -41,10 +44,20 @@ type Client struct {
 	pending map[uint64]*Call
 	closing bool
 	shutdown bool
+	limiter *Limiter
+	creds Credentials
 }
 
 var ShutDownErr = errors.New("connection is closing")
 
+// ServerError is an error returned by the remote service, as opposed to a
+// transport or timeout error.
+type ServerError string
+
+func (e ServerError) Error() string {
+	return string(e)
+}
+
 func (c *Client) Close() error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -78,6 +91,9 @@ func (c *Client) removeCall(seq uint64) *Call {
 	defer c.mu.Unlock()
 	call := c.pending[seq]
 	delete(c.pending, seq)
+	if call != nil && c.limiter != nil {
+		c.limiter.Release()
+	}
 	return call
 }
 
@@ -87,7 +103,11 @@ func (c *Client) terminateCall(err error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	c.shutdown = true
-	for _, call := range c.pending {
+	for seq, call := range c.pending {
+		delete(c.pending, seq)
+		if c.limiter != nil {
+			c.limiter.Release()
+		}
 		call.Error = err
 		call.done()
 	}
@@ -104,8 +124,12 @@ func (c *Client) receive() {
 		switch {
 		case call == nil:
 			err = c.cc.ReadBody(nil)
+		case h.Code != "":
+			call.Error = &server.Error{Code: h.Code, Msg: h.Error, RetryAfter: h.RetryAfter}
+			err = c.cc.ReadBody(nil)
+			call.done()
 		case h.Error != "":
-			call.Error = errors.New(h.Error)
+			call.Error = ServerError(h.Error)
 			err = c.cc.ReadBody(nil)
 			call.done()
 		default:
@@ -172,7 +196,12 @@ func dialTimeout(f newClientFunc, network, address string, opts ...*server.Optio
 	if err != nil {
 		return nil, err
 	}
-	conn, err := net.DialTimeout(network, address, opt.ConnectTimeout)
+	var conn net.Conn
+	if opt.TLSConfig != nil {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: opt.ConnectTimeout}, network, address, opt.TLSConfig)
+	} else {
+		conn, err = net.DialTimeout(network, address, opt.ConnectTimeout)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -196,7 +225,6 @@ func dialTimeout(f newClientFunc, network, address string, opts ...*server.Optio
 		case result := <-ch:
 			return result.client, result.err
 	}
-	return NewClient(conn, opt)
 }
 
 func Dial(network, address string, opts ...*server.Option) (*Client, error) {
@@ -209,6 +237,9 @@ func (c *Client) send(call *Call) {
 
 	seq, err := c.registerCall(call)
 	if err != nil {
+		if c.limiter != nil {
+			c.limiter.Release()
+		}
 		call.Error = err
 		call.done()
 		return
@@ -216,6 +247,8 @@ func (c *Client) send(call *Call) {
 
 	c.header.ServiceMethod = call.ServiceMethod
 	c.header.Seq = call.Seq
+	c.header.Version = call.Version
+	c.header.Metadata = call.Metadata
 	c.header.Error = ""
 
 	if err := c.cc.Write(&c.header, call.Args); err != nil {
@@ -239,12 +272,77 @@ func (c *Client) Go(serviceMethod string, args, reply interface{}, done chan *Ca
 		Reply: reply,
 		Done: done,
 	}
+	md, err := c.metadata(context.Background(), serviceMethod, args)
+	if err != nil {
+		call.Error = err
+		call.done()
+		return call
+	}
+	call.Metadata = md
+	if c.limiter != nil {
+		if err := c.limiter.Acquire(context.Background(), serviceMethod); err != nil {
+			call.Error = err
+			call.done()
+			return call
+		}
+	}
 	c.send(call)
 	return call
 }
 
+type versionCtx struct{}
+
+// WithVersion returns a copy of ctx asking calls made with it for a
+// version of the service satisfying constraint, such as "^1.2".
+func WithVersion(ctx context.Context, constraint string) context.Context {
+	return context.WithValue(ctx, versionCtx{}, constraint)
+}
+
+// VersionFromContext returns the version constraint set by WithVersion.
+func VersionFromContext(ctx context.Context) string {
+	v, _ := ctx.Value(versionCtx{}).(string)
+	return v
+}
+
+type metadataCtx struct{}
+
+// WithMetadata returns a copy of ctx adding the key/value pair to the
+// metadata sent with calls made with it, e.g. to identify the tenant.
+func WithMetadata(ctx context.Context, key, value string) context.Context {
+	md := make(map[string]string)
+	for k, v := range MetadataFromContext(ctx) {
+		md[k] = v
+	}
+	md[key] = value
+	return context.WithValue(ctx, metadataCtx{}, md)
+}
+
+// MetadataFromContext returns the metadata set by WithMetadata. It must not
+// be modified.
+func MetadataFromContext(ctx context.Context) map[string]string {
+	md, _ := ctx.Value(metadataCtx{}).(map[string]string)
+	return md
+}
+
 func (c *Client) Call(ctx context.Context, serviceMethod string, args, reply interface{}) error {
-	call := c.Go(serviceMethod, args, reply, make(chan *Call, 1))
+	md, err := c.metadata(ctx, serviceMethod, args)
+	if err != nil {
+		return err
+	}
+	call := &Call {
+		ServiceMethod: serviceMethod,
+		Args: args,
+		Reply: reply,
+		Version: VersionFromContext(ctx),
+		Metadata: md,
+		Done: make(chan *Call, 1),
+	}
+	if c.limiter != nil {
+		if err := c.limiter.Acquire(ctx, serviceMethod); err != nil {
+			return err
+		}
+	}
+	c.send(call)
 	select {
 	case <- ctx.Done():
 		c.removeCall(call.Seq)
@@ -273,6 +371,9 @@ func DialHTTP(network, address string, opts ...*server.Option) (*Client, error)
 	return dialTimeout(NewHTTPClient, network, address, opts...)
 }
 
+// XDial dials rpcAddr of the form protocol@addr, where protocol is http,
+// tls or a network such as tcp or unix. tls connects over TCP with the TLS
+// configuration of the option, or the default one if it has none.
 func XDial(rpcAddr string, opts ...*server.Option) (*Client, error) {
 	parts := strings.Split(rpcAddr, "@")
 	if len(parts) != 2 {
@@ -282,6 +383,17 @@ func XDial(rpcAddr string, opts ...*server.Option) (*Client, error) {
 	switch protocol {
 	case "http":
 		return DialHTTP("tcp", addr, opts...)
+	case "tls":
+		opt, err := parseOptions(opts...)
+		if err != nil {
+			return nil, err
+		}
+		if opt.TLSConfig == nil {
+			o := *opt
+			o.TLSConfig = new(tls.Config)
+			opt = &o
+		}
+		return Dial("tcp", addr, opt)
 	default:
 		// tcp
 		return Dial(protocol, addr, opts...)
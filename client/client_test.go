@@ -35,30 +35,23 @@ func TestXDial(t *testing.T) {
             _ = os.Remove(addr) // 测试后清理
         }()
         
+        // 注册测试服务
+        var testSvc TestService
+        if err := server.Register(&testSvc); err != nil {
+            t.Fatalf("register error: %v", err)
+        }
+
+        l, err := net.Listen("unix", addr)
+        if err != nil {
+            t.Fatalf("failed to listen unix socket: %v", err)
+        }
+
         var wg sync.WaitGroup
         wg.Add(1)
         
         go func() {
             defer wg.Done()
-            
-            // 注册测试服务
-            var testSvc TestService
-            if err := server.Register(&testSvc); err != nil {
-                t.Errorf("register error: %v", err)
-                return
-            }
-            
-            l, err := net.Listen("unix", addr)
-            if err != nil {
-                t.Errorf("failed to listen unix socket: %v", err)
-                return
-            }
-            defer l.Close()
-            
-            // 等待一小段时间确保服务器启动
-            time.Sleep(100 * time.Millisecond)
-            
-            // 使用Accept而不是Accept来避免阻塞
+            // 监听关闭后Accept返回
             server.DefaultServer.Accept(l)
         }()
         
@@ -83,6 +76,7 @@ func TestXDial(t *testing.T) {
             _assert(t, reply == "echo: hello", "unexpected reply: %s", reply)
         }
         
+        _ = l.Close()
         wg.Wait()
     }
 }
@@ -110,3 +104,38 @@ func TestXDialInvalidFormat(t *testing.T) {
         }
     }
 }
+
+func TestServerErrorCode(t *testing.T) {
+    s := server.NewServer()
+    var testSvc TestService
+    _ = s.Register(&testSvc)
+    s.SetRateLimit("TestService.Echo", server.RateLimit{Rate: 1, Burst: 1, Key: "tenant"})
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatalf("network error: %v", err)
+    }
+    defer l.Close()
+    go s.Accept(l)
+
+    client, err := Dial("tcp", l.Addr().String())
+    if err != nil {
+        t.Fatalf("dial error: %v", err)
+    }
+    defer client.Close()
+
+    // 元数据随请求发送，服务端拒绝时返回状态码和重试提示
+    ctx := WithMetadata(context.Background(), "tenant", "a")
+    var reply string
+    err = client.Call(ctx, "TestService.Echo", "hi", &reply)
+    _assert(t, err == nil, "first call error: %v", err)
+    err = client.Call(ctx, "TestService.Echo", "hi", &reply)
+    retryAfter, ok := server.RetryAfter(err)
+    _assert(t, server.IsRateLimited(err) && ok && retryAfter > 0, "expected rate limited error, got %v", err)
+    err = client.Call(WithMetadata(ctx, "tenant", "b"), "TestService.Echo", "hi", &reply)
+    _assert(t, err == nil, "other tenant limited: %v", err)
+
+    // 没有状态码的错误仍是ServerError
+    err = client.Call(ctx, "TestService.Missing", "hi", &reply)
+    _, isServerErr := err.(ServerError)
+    _assert(t, isServerErr, "unexpected error type %T", err)
+}
@@ -0,0 +1,90 @@
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"time"
+
+	"gorpc/server"
+)
+
+// Credentials provides the credentials sent with each call, as request
+// metadata checked by the Authenticator of the server.
+type Credentials interface {
+	Metadata(ctx context.Context, serviceMethod string, args interface{}) (map[string]string, error)
+}
+
+// CredentialsFunc adapts a function to Credentials.
+type CredentialsFunc func(ctx context.Context, serviceMethod string, args interface{}) (map[string]string, error)
+
+func (f CredentialsFunc) Metadata(ctx context.Context, serviceMethod string, args interface{}) (map[string]string, error) {
+	return f(ctx, serviceMethod, args)
+}
+
+// BearerToken sends token for server.BearerTokenAuth.
+func BearerToken(token string) Credentials {
+	return CredentialsFunc(func(ctx context.Context, serviceMethod string, args interface{}) (map[string]string, error) {
+		return map[string]string{server.AuthorizationKey: "Bearer " + token}, nil
+	})
+}
+
+// HMACCredentials signs each call, its arguments included, with secret
+// for server.HMACAuth.
+func HMACCredentials(keyID string, secret []byte) Credentials {
+	return CredentialsFunc(func(ctx context.Context, serviceMethod string, args interface{}) (map[string]string, error) {
+		digest, err := server.ArgsDigest(args)
+		if err != nil {
+			return nil, err
+		}
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		ts, nonce := time.Now().Unix(), hex.EncodeToString(b)
+		sig := server.HMACSignature(secret, keyID, ts, nonce, serviceMethod, digest)
+		return map[string]string{server.AuthorizationKey: "HMAC " + keyID + ":" + strconv.FormatInt(ts, 10) + ":" + nonce + ":" + sig}, nil
+	})
+}
+
+// SetCredentials makes the client send the metadata of creds with every
+// call, unless the context of the call carries credentials of its own set
+// by WithCredentials. It must be called before the client is used.
+func (c *Client) SetCredentials(creds Credentials) {
+	c.creds = creds
+}
+
+type credentialsCtx struct{}
+
+// WithCredentials returns a copy of ctx whose calls send the credentials
+// of creds rather than those of the client.
+func WithCredentials(ctx context.Context, creds Credentials) context.Context {
+	return context.WithValue(ctx, credentialsCtx{}, creds)
+}
+
+// metadata returns the metadata of a call: that of ctx together with the
+// credentials.
+func (c *Client) metadata(ctx context.Context, serviceMethod string, args interface{}) (map[string]string, error) {
+	md := MetadataFromContext(ctx)
+	creds, _ := ctx.Value(credentialsCtx{}).(Credentials)
+	if creds == nil {
+		creds = c.creds
+	}
+	if creds == nil {
+		return md, nil
+	}
+	cmd, err := creds.Metadata(ctx, serviceMethod, args)
+	if err != nil {
+		return nil, fmt.Errorf("rpc client: credentials: %w", err)
+	}
+	merged := make(map[string]string, len(md)+len(cmd))
+	for k, v := range md {
+		merged[k] = v
+	}
+	for k, v := range cmd {
+		merged[k] = v
+	}
+	return merged, nil
+}
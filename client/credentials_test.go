@@ -0,0 +1,80 @@
+package client
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"gorpc/server"
+)
+
+type Ident int
+
+func (i *Ident) Who(ctx context.Context, args int, reply *string) error {
+	*reply = server.IdentityFromContext(ctx)
+	return nil
+}
+
+type Tagged struct {
+	Tags  []string
+	Attrs map[string]int
+	Note  string
+}
+
+func (i *Ident) Tag(ctx context.Context, args Tagged, reply *string) error {
+	*reply = server.IdentityFromContext(ctx)
+	return nil
+}
+
+func TestCredentials(t *testing.T) {
+	s := server.NewServer()
+	var ident Ident
+	_ = s.Register(&ident)
+	var vident Ident
+	_ = s.RegisterVersion("VIdent", "1.0.0", &vident)
+	s.SetAuth(server.AnyAuth(
+		server.BearerTokenAuth(map[string]string{"t1": "alice"}),
+		server.HMACAuth(map[string][]byte{"bob": []byte("key")}, time.Minute),
+	), nil)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("network error: %v", err)
+	}
+	defer l.Close()
+	go s.Accept(l)
+
+	c, err := Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer c.Close()
+	var who string
+	err = c.Call(context.Background(), "Ident.Who", 0, &who)
+	_assert(t, server.IsPermissionDenied(err), "expected unauthenticated, got %v", err)
+
+	// 客户端级别的凭证随每次调用发送
+	c.SetCredentials(BearerToken("t1"))
+	err = c.Call(context.Background(), "Ident.Who", 0, &who)
+	_assert(t, err == nil && who == "alice", "bearer call: %q, %v", who, err)
+	call := <-c.Go("Ident.Who", 0, &who, nil).Done
+	_assert(t, call.Error == nil && who == "alice", "bearer go: %q, %v", who, call.Error)
+
+	// 单次调用可以通过ctx覆盖凭证
+	ctx := WithCredentials(context.Background(), HMACCredentials("bob", []byte("key")))
+	err = c.Call(ctx, "Ident.Who", 0, &who)
+	_assert(t, err == nil && who == "bob", "hmac call: %q, %v", who, err)
+
+	// 签名覆盖客户端发送的方法名；gob不传输的空切片、空map等零值不影响摘要
+	err = c.Call(ctx, "VIdent@1.0.0.Who", 0, &who)
+	_assert(t, err == nil && who == "bob", "hmac versioned call: %q, %v", who, err)
+	args := Tagged{Tags: []string{}, Attrs: map[string]int{"a": 0, "b": 1}}
+	err = c.Call(ctx, "Ident.Tag", args, &who)
+	_assert(t, err == nil && who == "bob", "hmac call with empty values: %q, %v", who, err)
+	type otherTagged struct {
+		Tags  []string
+		Attrs map[string]int64
+	}
+	err = c.Call(ctx, "Ident.Tag", &otherTagged{Tags: []string{"x"}}, &who)
+	_assert(t, err == nil && who == "bob", "hmac call with another type: %q, %v", who, err)
+}
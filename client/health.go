@@ -0,0 +1,35 @@
+package client
+
+import (
+	"context"
+
+	"gorpc/server"
+)
+
+// WatchHealth reports the serving status of service on the returned
+// channel, starting with the current status and then every change. The
+// channel is closed when ctx is done or a call fails.
+func (c *Client) WatchHealth(ctx context.Context, service string) <-chan server.ServingStatus {
+	ch := make(chan server.ServingStatus, 1)
+	go func() {
+		defer close(ch)
+		var last server.ServingStatus
+		for {
+			var resp server.HealthCheckResponse
+			req := &server.HealthWatchRequest{Service: service, LastStatus: last}
+			if err := c.Call(ctx, server.HealthService+".Watch", req, &resp); err != nil {
+				return
+			}
+			if resp.Status == last {
+				continue
+			}
+			last = resp.Status
+			select {
+			case ch <- last:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch
+}
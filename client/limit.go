@@ -0,0 +1,99 @@
+package client
+
+import (
+	"context"
+	"fmt"
+
+	"gorpc/ratelimit"
+	"gorpc/server"
+)
+
+// Limits bounds the calls sent by a client so that a runaway caller can't
+// overload the servers.
+type Limits struct {
+	MaxPending int     // calls awaiting their reply, 0 for no limit
+	Rate       float64 // calls per second to each service method, 0 for no limit
+	Burst      int
+	// FailFast makes calls over a limit fail at once with a
+	// RESOURCE_EXHAUSTED or RATE_LIMITED *server.Error instead of waiting.
+	FailFast bool
+}
+
+// Limiter enforces Limits. Each call must Acquire before being sent and
+// Release once it is done.
+type Limiter struct {
+	slots    chan struct{}
+	buckets  *ratelimit.Buckets
+	failFast bool
+}
+
+func NewLimiter(l Limits) *Limiter {
+	lim := &Limiter{failFast: l.FailFast}
+	if l.MaxPending > 0 {
+		lim.slots = make(chan struct{}, l.MaxPending)
+	}
+	if l.Rate > 0 {
+		lim.buckets = ratelimit.NewBuckets(l.Rate, l.Burst)
+	}
+	return lim
+}
+
+// Acquire takes a token of the rate limit of serviceMethod and a slot for
+// the call, waiting for them unless the limiter fails fast. If no slot is
+// had, the token is given back.
+func (l *Limiter) Acquire(ctx context.Context, serviceMethod string) error {
+	var b *ratelimit.Bucket
+	if l.buckets != nil {
+		b = l.buckets.Get(serviceMethod)
+		if l.failFast {
+			if ok, retryAfter := b.Allow(); !ok {
+				return &server.Error{
+					Code:       server.CodeRateLimited,
+					Msg:        fmt.Sprintf("rpc client: rate limit of %s exceeded, retry after %s", serviceMethod, retryAfter),
+					RetryAfter: retryAfter,
+				}
+			}
+		} else if err := b.Wait(ctx); err != nil {
+			return fmt.Errorf("rpc client: call failed: %w", err)
+		}
+	}
+	if l.slots == nil {
+		return nil
+	}
+	err := l.acquireSlot(ctx)
+	if err != nil && b != nil {
+		b.GiveBack()
+	}
+	return err
+}
+
+func (l *Limiter) acquireSlot(ctx context.Context) error {
+	if l.failFast {
+		select {
+		case l.slots <- struct{}{}:
+			return nil
+		default:
+			return &server.Error{Code: server.CodeResourceExhausted, Msg: "rpc client: too many outstanding calls"}
+		}
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("rpc client: call failed: %w", ctx.Err())
+	}
+}
+
+// Release gives back the slot of a call.
+func (l *Limiter) Release() {
+	if l.slots != nil {
+		<-l.slots
+	}
+}
+
+// SetLimits limits the calls sent by the client. Go waits for the limits
+// like Call does with a context that is never done. It must be called
+// before the client is used.
+func (c *Client) SetLimits(l Limits) {
+	c.limiter = NewLimiter(l)
+}
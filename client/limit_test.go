@@ -0,0 +1,99 @@
+package client
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"gorpc/server"
+)
+
+type Sleeper int
+
+func (s *Sleeper) Sleep(ms int, reply *int) error {
+	time.Sleep(time.Duration(ms) * time.Millisecond)
+	*reply = ms
+	return nil
+}
+
+func dialSleeper(t *testing.T, l Limits) *Client {
+	t.Helper()
+	s := server.NewServer()
+	var sleeper Sleeper
+	_ = s.Register(&sleeper)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("network error: %v", err)
+	}
+	t.Cleanup(func() { _ = lis.Close() })
+	go s.Accept(lis)
+	c, err := Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	t.Cleanup(func() { _ = c.Close() })
+	c.SetLimits(l)
+	return c
+}
+
+func TestMaxPending(t *testing.T) {
+	// 快速失败：超出未完成调用数上限时立即返回
+	c := dialSleeper(t, Limits{MaxPending: 1, FailFast: true})
+	call := c.Go("Sleeper.Sleep", 100, new(int), nil)
+	err := c.Call(context.Background(), "Sleeper.Sleep", 0, new(int))
+	_assert(t, server.IsResourceExhausted(err), "expected resource exhausted, got %v", err)
+	<-call.Done
+	err = c.Call(context.Background(), "Sleeper.Sleep", 0, new(int))
+	_assert(t, err == nil, "slot not released: %v", err)
+
+	// 阻塞：等待之前的调用完成
+	c = dialSleeper(t, Limits{MaxPending: 1})
+	start := time.Now()
+	call = c.Go("Sleeper.Sleep", 100, new(int), nil)
+	err = c.Call(context.Background(), "Sleeper.Sleep", 0, new(int))
+	_assert(t, err == nil && call.Error == nil, "call error: %v, %v", err, call.Error)
+	_assert(t, time.Since(start) >= 100*time.Millisecond, "call did not wait for a slot")
+
+	// 等待时ctx结束则返回错误，且不占用名额
+	call = c.Go("Sleeper.Sleep", 100, new(int), nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err = c.Call(ctx, "Sleeper.Sleep", 0, new(int))
+	_assert(t, err != nil, "expected timeout waiting for a slot")
+	<-call.Done
+	err = c.Call(context.Background(), "Sleeper.Sleep", 0, new(int))
+	_assert(t, err == nil, "slot leaked: %v", err)
+}
+
+func TestClientRateLimit(t *testing.T) {
+	c := dialSleeper(t, Limits{Rate: 20, Burst: 1, FailFast: true})
+	err := c.Call(context.Background(), "Sleeper.Sleep", 0, new(int))
+	_assert(t, err == nil, "first call error: %v", err)
+	err = c.Call(context.Background(), "Sleeper.Sleep", 0, new(int))
+	retryAfter, ok := server.RetryAfter(err)
+	_assert(t, server.IsRateLimited(err) && ok && retryAfter <= 50*time.Millisecond,
+		"expected rate limited error, got %v", err)
+
+	c = dialSleeper(t, Limits{Rate: 20, Burst: 1})
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		err := c.Call(context.Background(), "Sleeper.Sleep", 0, new(int))
+		_assert(t, err == nil, "call error: %v", err)
+	}
+	_assert(t, time.Since(start) >= 90*time.Millisecond, "calls were not rate limited")
+}
+
+func TestLimiterGiveBack(t *testing.T) {
+	l := NewLimiter(Limits{MaxPending: 1, Rate: 0.001, Burst: 2, FailFast: true})
+	ctx := context.Background()
+	err := l.Acquire(ctx, "Sleeper.Sleep")
+	_assert(t, err == nil, "first acquire error: %v", err)
+
+	// 没有空闲槽位时，已取得的令牌被归还
+	err = l.Acquire(ctx, "Sleeper.Sleep")
+	_assert(t, server.IsResourceExhausted(err), "expected no slot, got %v", err)
+	l.Release()
+	err = l.Acquire(ctx, "Sleeper.Sleep")
+	_assert(t, err == nil, "token lost with the slot: %v", err)
+}
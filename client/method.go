@@ -0,0 +1,139 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+
+	"gorpc/server"
+)
+
+// Caller is implemented by Client and xclient.XClient.
+type Caller interface {
+	Call(ctx context.Context, serviceMethod string, args, reply interface{}) error
+}
+
+// Method is a typed handle on a remote method, so that the types of the
+// arguments and the reply are checked at compile time:
+//
+//	sum := client.NewMethod[Args, int](c, "Foo.Sum")
+//	reply, err := sum.Call(ctx, Args{Num1: 1, Num2: 2})
+type Method[Args, Reply any] struct {
+	caller        Caller
+	serviceMethod string
+	validate      bool
+	mu            sync.Mutex
+	validated     bool
+	err           error // signature mismatch found by validation
+}
+
+func NewMethod[Args, Reply any](c Caller, serviceMethod string) *Method[Args, Reply] {
+	return &Method[Args, Reply]{caller: c, serviceMethod: serviceMethod}
+}
+
+// Validated makes the first call check the signature of the method against
+// the reflection data of the server, failing every call if they differ.
+func (m *Method[Args, Reply]) Validated() *Method[Args, Reply] {
+	m.validate = true
+	return m
+}
+
+func (m *Method[Args, Reply]) Call(ctx context.Context, args Args) (Reply, error) {
+	var reply Reply
+	if m.validate {
+		if err := m.Validate(ctx); err != nil {
+			return reply, err
+		}
+	}
+	err := m.caller.Call(ctx, m.serviceMethod, args, &reply)
+	return reply, err
+}
+
+// Validate checks that Args and Reply match the types the server declares
+// for the method. A mismatch is remembered; a failed lookup is retried on
+// the next call.
+func (m *Method[Args, Reply]) Validate(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.validated {
+		return m.err
+	}
+	dot := strings.LastIndex(m.serviceMethod, ".")
+	if dot < 0 {
+		return fmt.Errorf("rpc client: service/method ill-formed: %s", m.serviceMethod)
+	}
+	serviceName, methodName := m.serviceMethod[:dot], m.serviceMethod[dot+1:]
+	var svc server.ServiceInfo
+	req := &server.ReflectionRequest{Service: serviceName, Version: VersionFromContext(ctx)}
+	if err := m.caller.Call(ctx, server.ReflectionService+".DescribeService", req, &svc); err != nil {
+		return err
+	}
+	m.validated = true
+	for _, method := range svc.Methods {
+		if method.Name != methodName {
+			continue
+		}
+		argType := server.DescribeType(reflect.TypeOf((*Args)(nil)).Elem())
+		replyType := server.DescribeType(reflect.TypeOf((*Reply)(nil)))
+		if !compatibleType(argType, method.ArgType) {
+			m.err = fmt.Errorf("rpc client: %s takes %s, not %s", m.serviceMethod, method.ArgType.Name, argType.Name)
+		} else if !compatibleType(replyType, method.ReplyType) {
+			m.err = fmt.Errorf("rpc client: %s replies %s, not %s", m.serviceMethod, method.ReplyType.Name, replyType.Name)
+		}
+		return m.err
+	}
+	m.err = fmt.Errorf("rpc client: method %s not found", m.serviceMethod)
+	return m.err
+}
+
+// compatibleType reports whether values of a and b are interchangeable on
+// the wire: pointers are transparent, type names are ignored and integers
+// (or floats) of any size match.
+func compatibleType(a, b *server.TypeInfo) bool {
+	for a.Kind == "ptr" {
+		a = a.Elem
+	}
+	for b.Kind == "ptr" {
+		b = b.Elem
+	}
+	if kindClass(a.Kind) != kindClass(b.Kind) {
+		return false
+	}
+	switch a.Kind {
+	case "slice", "array":
+		return compatibleType(a.Elem, b.Elem)
+	case "map":
+		return compatibleType(a.Key, b.Key) && compatibleType(a.Elem, b.Elem)
+	case "struct":
+		if len(a.Fields) != len(b.Fields) {
+			return false
+		}
+		fields := make(map[string]*server.TypeInfo, len(b.Fields))
+		for _, f := range b.Fields {
+			fields[f.Name] = f.Type
+		}
+		for _, f := range a.Fields {
+			t, ok := fields[f.Name]
+			if !ok || !compatibleType(f.Type, t) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func kindClass(kind string) string {
+	switch {
+	case strings.HasPrefix(kind, "int"), strings.HasPrefix(kind, "uint"):
+		return "int"
+	case strings.HasPrefix(kind, "float"):
+		return "float"
+	case strings.HasPrefix(kind, "complex"):
+		return "complex"
+	case kind == "array":
+		return "slice"
+	}
+	return kind
+}
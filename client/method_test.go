@@ -0,0 +1,76 @@
+package client
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"gorpc/server"
+)
+
+type Calc int
+
+type SumArgs struct{ Num1, Num2 int }
+
+func (c *Calc) Sum(args SumArgs, reply *int) error {
+	*reply = args.Num1 + args.Num2
+	return nil
+}
+
+func TestMethod(t *testing.T) {
+	s := server.NewServer()
+	var calc Calc
+	if err := s.Register(&calc); err != nil {
+		t.Fatalf("register error: %v", err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("network error: %v", err)
+	}
+	defer l.Close()
+	go s.Accept(l)
+
+	c, err := Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	sum := NewMethod[SumArgs, int](c, "Calc.Sum").Validated()
+	reply, err := sum.Call(ctx, SumArgs{Num1: 1, Num2: 2})
+	_assert(t, err == nil && reply == 3, "sum: %d, %v", reply, err)
+
+	// 参数结构不同的同名类型也能通过校验，只要字段兼容
+	type otherArgs struct {
+		Num1 int64
+		Num2 int32
+	}
+	other := NewMethod[*otherArgs, int64](c, "Calc.Sum").Validated()
+	r, err := other.Call(ctx, &otherArgs{Num1: 3, Num2: 4})
+	_assert(t, err == nil && r == 7, "other: %d, %v", r, err)
+
+	// 类型不匹配或方法不存在时，首次调用即报错
+	bad := NewMethod[string, int](c, "Calc.Sum").Validated()
+	_, err = bad.Call(ctx, "1+2")
+	_assert(t, err != nil, "expected argument type mismatch")
+	badReply := NewMethod[SumArgs, string](c, "Calc.Sum").Validated()
+	_, err = badReply.Call(ctx, SumArgs{})
+	_assert(t, err != nil, "expected reply type mismatch")
+	missing := NewMethod[SumArgs, int](c, "Calc.Mul").Validated()
+	_, err = missing.Call(ctx, SumArgs{})
+	_assert(t, err != nil, "expected missing method")
+
+	// 只注册了带版本的服务时，按调用的版本约束校验
+	var v1 Calc
+	if err := s.RegisterVersion("VCalc", "1.0.0", &v1); err != nil {
+		t.Fatalf("register error: %v", err)
+	}
+	vctx := WithVersion(ctx, "^1")
+	vsum := NewMethod[SumArgs, int](c, "VCalc.Sum").Validated()
+	reply, err = vsum.Call(vctx, SumArgs{Num1: 1, Num2: 2})
+	_assert(t, err == nil && reply == 3, "versioned sum: %d, %v", reply, err)
+	_assert(t, vsum.validated, "versioned method not validated")
+}
@@ -0,0 +1,115 @@
+package client
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"gorpc/server"
+)
+
+// 生成由ca签发的证书，ca为nil时生成自签名的CA证书
+func newCert(t *testing.T, cn string, ca *tls.Certificate) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	parent, signer := tmpl, interface{}(key)
+	if ca == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+	} else {
+		parent, signer = ca.Leaf, ca.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+type Whoami int
+
+func (w *Whoami) Name(ctx context.Context, args int, reply *string) error {
+	if p, ok := server.PeerFromContext(ctx); ok {
+		*reply = p.Identity()
+	}
+	return nil
+}
+
+func TestTLS(t *testing.T) {
+	ca := newCert(t, "test ca", nil)
+	serverCert := newCert(t, "server", &ca)
+	clientCert := newCert(t, "alice", &ca)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+
+	s := server.NewServer()
+	var w Whoami
+	_ = s.Register(&w)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("network error: %v", err)
+	}
+	defer l.Close()
+	go s.AcceptTLS(l, &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+	})
+	addr := l.Addr().String()
+
+	// 双向TLS：处理函数可以从ctx中得到客户端证书的身份
+	opt := &server.Option{TLSConfig: &tls.Config{RootCAs: pool, Certificates: []tls.Certificate{clientCert}}}
+	c, err := XDial("tls@"+addr, opt)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer c.Close()
+	var name string
+	err = c.Call(context.Background(), "Whoami.Name", 0, &name)
+	_assert(t, err == nil && name == "alice", "unexpected identity %q, err %v", name, err)
+
+	// 单向TLS：没有客户端证书时身份为空
+	c2, err := Dial("tcp", addr, &server.Option{TLSConfig: &tls.Config{RootCAs: pool}})
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer c2.Close()
+	name = "unset"
+	err = c2.Call(context.Background(), "Whoami.Name", 0, &name)
+	_assert(t, err == nil && name == "", "unexpected identity %q, err %v", name, err)
+
+	// 不信任服务器证书时连接失败
+	_, err = XDial("tls@" + addr)
+	_assert(t, err != nil, "expected certificate verification error")
+
+	// 明文客户端无法调用
+	plain, err := Dial("tcp", addr)
+	if err == nil {
+		defer plain.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		err = plain.Call(ctx, "Whoami.Name", 0, &name)
+	}
+	_assert(t, err != nil, "plaintext call succeeded")
+}
@@ -0,0 +1,307 @@
+// Command gorpc-gen generates, from a Go interface describing a service, a
+// server adapter registering an implementation of the interface on a
+// server.Server and a typed client usable with both client.Client and
+// xclient.XClient. Producer and consumer then share the interface.
+//
+// Every method of the interface must have the form
+//
+//	Method(ctx context.Context, args Args) (Reply, error)
+//
+// Typical use is a go:generate directive next to the interface:
+//
+//	//go:generate gorpc-gen -type Arith
+//
+// which writes arith_gorpc.go with ArithService, RegisterArith, ArithClient
+// and NewArithClient.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+var (
+	typeNames = flag.String("type", "", "comma-separated list of interface names; required")
+	output    = flag.String("output", "", "output file name; default <type>_gorpc.go")
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: gorpc-gen -type T [directory]\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("gorpc-gen: ")
+	flag.Usage = usage
+	flag.Parse()
+	if *typeNames == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	dir := "."
+	if flag.NArg() > 0 {
+		dir = flag.Arg(0)
+	}
+	types := strings.Split(*typeNames, ",")
+
+	files, err := parseDir(dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	src, err := generate(files, types)
+	if err != nil {
+		log.Fatal(err)
+	}
+	name := *output
+	if name == "" {
+		name = strings.ToLower(types[0]) + "_gorpc.go"
+	}
+	if err := os.WriteFile(filepath.Join(dir, name), src, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func parseDir(dir string) ([]*ast.File, error) {
+	names, err := filepath.Glob(filepath.Join(dir, "*.go"))
+	if err != nil {
+		return nil, err
+	}
+	fset := token.NewFileSet()
+	var files []*ast.File
+	for _, name := range names {
+		if strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		f, err := parser.ParseFile(fset, name, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		if len(files) > 0 && f.Name.Name != files[0].Name.Name {
+			return nil, fmt.Errorf("found packages %s and %s in %s", files[0].Name.Name, f.Name.Name, dir)
+		}
+		files = append(files, f)
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no Go files in %s", dir)
+	}
+	return files, nil
+}
+
+type method struct {
+	Name  string
+	Args  string
+	Reply string
+}
+
+type service struct {
+	Name    string
+	Methods []method
+}
+
+// generate returns the source of the adapters and clients of the named
+// interfaces, all declared in files.
+func generate(files []*ast.File, names []string) ([]byte, error) {
+	imports := map[string]string{
+		"context": "context",
+		"client":  "gorpc/client",
+		"server":  "gorpc/server",
+	}
+	var services []service
+	for _, name := range names {
+		iface, file := findInterface(files, name)
+		if iface == nil {
+			return nil, fmt.Errorf("interface %s not found", name)
+		}
+		svc, err := parseInterface(name, iface, file, imports)
+		if err != nil {
+			return nil, err
+		}
+		services = append(services, svc)
+	}
+
+	paths := make([]string, 0, len(imports))
+	for name, path := range imports {
+		if filepath.Base(path) != name {
+			path = name + " " + strconv.Quote(path)
+		} else {
+			path = strconv.Quote(path)
+		}
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	var buf bytes.Buffer
+	err := tmpl.Execute(&buf, map[string]interface{}{
+		"Package":  files[0].Name.Name,
+		"Imports":  paths,
+		"Services": services,
+	})
+	if err != nil {
+		return nil, err
+	}
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("formatting generated code: %v\n%s", err, buf.Bytes())
+	}
+	return src, nil
+}
+
+func findInterface(files []*ast.File, name string) (*ast.InterfaceType, *ast.File) {
+	for _, f := range files {
+		for _, decl := range f.Decls {
+			gen, ok := decl.(*ast.GenDecl)
+			if !ok || gen.Tok != token.TYPE {
+				continue
+			}
+			for _, spec := range gen.Specs {
+				ts := spec.(*ast.TypeSpec)
+				if iface, ok := ts.Type.(*ast.InterfaceType); ok && ts.Name.Name == name {
+					return iface, f
+				}
+			}
+		}
+	}
+	return nil, nil
+}
+
+func parseInterface(name string, iface *ast.InterfaceType, file *ast.File, imports map[string]string) (service, error) {
+	svc := service{Name: name}
+	for _, field := range iface.Methods.List {
+		fn, ok := field.Type.(*ast.FuncType)
+		if !ok || len(field.Names) != 1 {
+			return svc, fmt.Errorf("%s: embedded interfaces are not supported", name)
+		}
+		m := field.Names[0].Name
+		params, results := flatten(fn.Params), flatten(fn.Results)
+		if len(params) != 2 || expr(params[0]) != "context.Context" {
+			return svc, fmt.Errorf("%s.%s: expected parameters (context.Context, Args)", name, m)
+		}
+		if len(results) != 2 || expr(results[1]) != "error" {
+			return svc, fmt.Errorf("%s.%s: expected results (Reply, error)", name, m)
+		}
+		for _, t := range []ast.Expr{params[1], results[0]} {
+			if err := addImports(t, file, imports); err != nil {
+				return svc, fmt.Errorf("%s.%s: %v", name, m, err)
+			}
+		}
+		svc.Methods = append(svc.Methods, method{Name: m, Args: expr(params[1]), Reply: expr(results[0])})
+	}
+	return svc, nil
+}
+
+// flatten returns the type of each parameter of fields, expanding grouped
+// declarations such as (a, b int).
+func flatten(fields *ast.FieldList) []ast.Expr {
+	if fields == nil {
+		return nil
+	}
+	var types []ast.Expr
+	for _, f := range fields.List {
+		n := max(len(f.Names), 1)
+		for i := 0; i < n; i++ {
+			types = append(types, f.Type)
+		}
+	}
+	return types
+}
+
+func expr(e ast.Expr) string {
+	var buf bytes.Buffer
+	_ = format.Node(&buf, token.NewFileSet(), e)
+	return buf.String()
+}
+
+// addImports records the imports of file that the type t refers to.
+func addImports(t ast.Expr, file *ast.File, imports map[string]string) error {
+	var err error
+	ast.Inspect(t, func(n ast.Node) bool {
+		sel, ok := n.(*ast.SelectorExpr)
+		if !ok {
+			return true
+		}
+		pkg, ok := sel.X.(*ast.Ident)
+		if !ok {
+			return true
+		}
+		for _, spec := range file.Imports {
+			path, _ := strconv.Unquote(spec.Path.Value)
+			name := filepath.Base(path)
+			if spec.Name != nil {
+				name = spec.Name.Name
+			}
+			if name == pkg.Name {
+				if old, ok := imports[name]; ok && old != path {
+					err = fmt.Errorf("package name %s refers to both %s and %s", name, old, path)
+				}
+				imports[name] = path
+				return false
+			}
+		}
+		err = fmt.Errorf("unknown package %s", pkg.Name)
+		return false
+	})
+	return err
+}
+
+var tmpl = template.Must(template.New("gorpc").Parse(`// Code generated by gorpc-gen. DO NOT EDIT.
+
+package {{.Package}}
+
+import (
+{{- range .Imports}}
+	{{.}}
+{{- end}}
+)
+{{range $svc := .Services}}
+// {{.Name}}Service adapts an implementation of {{.Name}} to the method
+// signatures served by server.Server.
+type {{.Name}}Service struct {
+	impl {{.Name}}
+}
+
+// Register{{.Name}} registers impl on s as the {{.Name}} service.
+func Register{{.Name}}(s *server.Server, impl {{.Name}}) error {
+	return s.RegisterName("{{.Name}}", &{{.Name}}Service{impl})
+}
+{{range .Methods}}
+func (s *{{$svc.Name}}Service) {{.Name}}(ctx context.Context, args {{.Args}}, reply *{{.Reply}}) error {
+	r, err := s.impl.{{.Name}}(ctx, args)
+	if err != nil {
+		return err
+	}
+	*reply = r
+	return nil
+}
+{{end}}
+// {{.Name}}Client calls {{.Name}} through a client.Client or an
+// xclient.XClient.
+type {{.Name}}Client struct {
+	c client.Caller
+}
+
+var _ {{.Name}} = (*{{.Name}}Client)(nil)
+
+func New{{.Name}}Client(c client.Caller) *{{.Name}}Client {
+	return &{{.Name}}Client{c}
+}
+{{range .Methods}}
+func (c *{{$svc.Name}}Client) {{.Name}}(ctx context.Context, args {{.Args}}) ({{.Reply}}, error) {
+	var reply {{.Reply}}
+	err := c.c.Call(ctx, "{{$svc.Name}}.{{.Name}}", args, &reply)
+	return reply, err
+}
+{{end}}
+{{- end}}`))
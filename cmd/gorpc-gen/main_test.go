@@ -0,0 +1,105 @@
+package main
+
+import (
+	"go/ast"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func parseSource(t *testing.T, src string) []*ast.File {
+	t.Helper()
+	f, err := parser.ParseFile(token.NewFileSet(), "arith.go", src, 0)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	return []*ast.File{f}
+}
+
+// typeCheck type-checks the files of a package against the gorpc packages,
+// imported from source. The files are placed in this directory so that
+// imports are resolved within the module.
+func typeCheck(t *testing.T, files map[string][]byte) {
+	t.Helper()
+	dir, err := filepath.Abs(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fset := token.NewFileSet()
+	var parsed []*ast.File
+	for name, src := range files {
+		f, err := parser.ParseFile(fset, filepath.Join(dir, name), src, 0)
+		if err != nil {
+			t.Fatalf("parse %s error: %v\n%s", name, err, src)
+		}
+		parsed = append(parsed, f)
+	}
+	conf := types.Config{Importer: importer.ForCompiler(fset, "source", nil)}
+	if _, err := conf.Check("arith", fset, parsed, nil); err != nil {
+		t.Fatalf("generated code does not type-check: %v\n%s", err, files["arith_gorpc.go"])
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	const arith = `package arith
+
+import (
+	"context"
+	tm "time"
+)
+
+type Args struct{ Num1, Num2 int }
+
+type Arith interface {
+	Sum(ctx context.Context, args Args) (int, error)
+	Wait(ctx context.Context, d tm.Duration) ([]string, error)
+}
+`
+	files := parseSource(t, arith)
+	src, err := generate(files, []string{"Arith"})
+	if err != nil {
+		t.Fatalf("generate error: %v", err)
+	}
+	out := string(src)
+	// 生成的代码必须能与接口定义一起通过类型检查
+	typeCheck(t, map[string][]byte{"arith.go": []byte(arith), "arith_gorpc.go": src})
+	for _, want := range []string{
+		"package arith",
+		`tm "time"`,
+		"func RegisterArith(s *server.Server, impl Arith) error",
+		"func (s *ArithService) Sum(ctx context.Context, args Args, reply *int) error",
+		"func (s *ArithService) Wait(ctx context.Context, args tm.Duration, reply *[]string) error",
+		"var _ Arith = (*ArithClient)(nil)",
+		"func NewArithClient(c client.Caller) *ArithClient",
+		`s.RegisterName("Arith", &ArithService{impl})`,
+		`c.c.Call(ctx, "Arith.Sum", args, &reply)`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("generated code lacks %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestGenerateErrors(t *testing.T) {
+	files := parseSource(t, `package arith
+
+import "context"
+
+type NoContext interface {
+	Sum(args int) (int, error)
+}
+
+type NoError interface {
+	Sum(ctx context.Context, args int) int
+}
+`)
+	for _, name := range []string{"NoContext", "NoError", "Missing"} {
+		if _, err := generate(files, []string{name}); err == nil {
+			t.Errorf("expected error for %s", name)
+		}
+	}
+}
@@ -0,0 +1,295 @@
+// Command gorpc is a command-line client for gorpc servers. It lists and
+// describes services through the built-in reflection service and invokes
+// methods with JSON arguments, either on one server or through a registry
+// with client-side load balancing.
+//
+// Usage:
+//
+//	gorpc -addr tcp@localhost:8080 list
+//	gorpc -addr tcp@localhost:8080 describe Foo
+//	gorpc -addr tcp@localhost:8080 call Foo.Sum '{"Num1": 1, "Num2": 2}'
+//	gorpc -registry http://localhost:9999/_gorpc_/registry servers
+//	gorpc -registry http://localhost:9999/_gorpc_/registry -mode p2c call Foo.Sum '{"Num1": 1, "Num2": 2}'
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"gorpc/client"
+	"gorpc/codec"
+	"gorpc/server"
+	"gorpc/xclient"
+)
+
+// caller is satisfied by both client.Client and xclient.XClient.
+type caller interface {
+	Call(ctx context.Context, serviceMethod string, args, reply interface{}) error
+	Close() error
+}
+
+var modes = map[string]xclient.SelectMode{
+	"random":       xclient.RandomSelect,
+	"roundrobin":   xclient.RoundRobinSelect,
+	"weighted":     xclient.WeightRoundRobinSelect,
+	"hash":         xclient.ConsistentHashSelect,
+	"leastrequest": xclient.LeastRequestSelect,
+	"p2c":          xclient.P2CSelect,
+}
+
+var (
+	addr     = flag.String("addr", "", "server address as protocol@addr, e.g. tcp@localhost:8080, tls@localhost:8443, unix@/tmp/rpc.sock or http@localhost:8080")
+	registry = flag.String("registry", "", "registry URL, used instead of -addr to call through load balancing")
+	mode     = flag.String("mode", "random", "load balancing mode with -registry: random, roundrobin, weighted, hash, leastrequest or p2c")
+	key      = flag.String("key", "", "routing key for -mode hash")
+	version  = flag.String("version", "", "version constraint of the called service, e.g. ^1.2")
+	timeout  = flag.Duration("timeout", 10*time.Second, "timeout of each call")
+	verbose  = flag.Bool("v", false, "print the library logs")
+	cacert   = flag.String("cacert", "", "PEM file of the CAs trusted for tls@ servers instead of the system ones")
+	cert     = flag.String("cert", "", "PEM file of the client certificate for mutual TLS")
+	certKey  = flag.String("certkey", "", "PEM file of the key of -cert")
+	token    = flag.String("token", "", "bearer token sent with every call")
+	regToken = flag.String("registry-token", "", "bearer token sent to the registry")
+)
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), `Usage: gorpc [flags] command [args]
+
+Commands:
+  list                          list the services and their methods
+  describe Service              print the methods and types of a service as JSON
+  call Service.Method [json]    call a method with JSON arguments (default null)
+  servers                       list the servers known to the registry and their metadata
+
+Flags:
+`)
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	log.SetFlags(0)
+	if !*verbose {
+		log.SetOutput(io.Discard)
+	}
+	if err := run(flag.Args()); err != nil {
+		fmt.Fprintln(os.Stderr, "gorpc:", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string) error {
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	cmd, args := args[0], args[1:]
+	if cmd == "servers" {
+		return servers()
+	}
+	c, err := dial()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = c.Close() }()
+	switch cmd {
+	case "list":
+		return list(c)
+	case "describe":
+		if len(args) != 1 {
+			return errors.New("usage: describe Service")
+		}
+		return describe(c, args[0])
+	case "call":
+		if len(args) != 1 && len(args) != 2 {
+			return errors.New("usage: call Service.Method [json]")
+		}
+		data := "null"
+		if len(args) == 2 {
+			data = args[1]
+		}
+		return call(c, args[0], data)
+	default:
+		return fmt.Errorf("unknown command %q", cmd)
+	}
+}
+
+// dial connects with the JSON codec so arguments and replies can be passed
+// through without knowing their Go types.
+func dial() (caller, error) {
+	opt := &server.Option{CodecType: codec.JsonType, ConnectTimeout: *timeout}
+	if *cacert != "" || *cert != "" {
+		cfg, err := tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		opt.TLSConfig = cfg
+	}
+	switch {
+	case *registry != "":
+		m, ok := modes[*mode]
+		if !ok {
+			return nil, fmt.Errorf("unknown mode %q", *mode)
+		}
+		return xclient.NewXClient(discovery(), m, opt), nil
+	case *addr != "":
+		return client.XDial(*addr, opt)
+	default:
+		return nil, errors.New("one of -addr or -registry is required")
+	}
+}
+
+func discovery() *xclient.GoRegistryDiscovery {
+	d := xclient.NewGoRegistryDiscovery(*registry, 0)
+	d.SetToken(*regToken)
+	return d
+}
+
+func tlsConfig() (*tls.Config, error) {
+	cfg := new(tls.Config)
+	if *cacert != "" {
+		pem, err := os.ReadFile(*cacert)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", *cacert)
+		}
+	}
+	if *cert != "" {
+		c, err := tls.LoadX509KeyPair(*cert, *certKey)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{c}
+	}
+	return cfg, nil
+}
+
+func callContext() (context.Context, context.CancelFunc) {
+	ctx := context.Background()
+	if *key != "" {
+		ctx = xclient.WithHashKey(ctx, *key)
+	}
+	if *version != "" {
+		ctx = client.WithVersion(ctx, *version)
+	}
+	if *token != "" {
+		ctx = client.WithCredentials(ctx, client.BearerToken(*token))
+	}
+	return context.WithTimeout(ctx, *timeout)
+}
+
+func list(c caller) error {
+	ctx, cancel := callContext()
+	defer cancel()
+	var resp server.ListServicesResponse
+	if err := c.Call(ctx, server.ReflectionService+".ListServices", &server.ReflectionRequest{}, &resp); err != nil {
+		return err
+	}
+	for _, name := range resp.Services {
+		svc, err := describeService(c, name)
+		if err != nil {
+			return err
+		}
+		fmt.Println(name)
+		for _, m := range svc.Methods {
+			fmt.Printf("\t%s(%s, %s) error\n", m.Name, m.ArgType.Name, m.ReplyType.Name)
+		}
+	}
+	return nil
+}
+
+func describeService(c caller, name string) (*server.ServiceInfo, error) {
+	ctx, cancel := callContext()
+	defer cancel()
+	var svc server.ServiceInfo
+	err := c.Call(ctx, server.ReflectionService+".DescribeService", &server.ReflectionRequest{Service: name, Version: *version}, &svc)
+	return &svc, err
+}
+
+func describe(c caller, name string) error {
+	svc, err := describeService(c, name)
+	if err != nil {
+		return err
+	}
+	return printJSON(svc)
+}
+
+func call(c caller, serviceMethod, data string) error {
+	if !json.Valid([]byte(data)) {
+		return fmt.Errorf("invalid JSON arguments: %s", data)
+	}
+	ctx, cancel := callContext()
+	defer cancel()
+	var reply json.RawMessage
+	if err := c.Call(ctx, serviceMethod, json.RawMessage(data), &reply); err != nil {
+		return err
+	}
+	var out bytes.Buffer
+	if err := json.Indent(&out, reply, "", "  "); err != nil {
+		return err
+	}
+	fmt.Println(out.String())
+	return nil
+}
+
+func servers() error {
+	if *registry == "" {
+		return errors.New("-registry is required")
+	}
+	d := discovery()
+	servers, err := d.GetAll()
+	if err != nil {
+		return err
+	}
+	sort.Strings(servers)
+	for _, addr := range servers {
+		fields := []string{addr}
+		if inst, ok := d.Instance(addr); ok {
+			if inst.Weight > 0 {
+				fields = append(fields, fmt.Sprintf("weight=%d", inst.Weight))
+			}
+			if inst.Zone != "" {
+				fields = append(fields, "zone="+inst.Zone)
+			}
+			if inst.Version != "" {
+				fields = append(fields, "version="+inst.Version)
+			}
+			if len(inst.Services) > 0 {
+				fields = append(fields, "services="+strings.Join(inst.Services, ","))
+			}
+			labels := make([]string, 0, len(inst.Labels))
+			for k, v := range inst.Labels {
+				labels = append(labels, k+"="+v)
+			}
+			sort.Strings(labels)
+			fields = append(fields, labels...)
+		}
+		fmt.Println(strings.Join(fields, "\t"))
+	}
+	return nil
+}
+
+func printJSON(v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(b))
+	return nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+
+	"gorpc/server"
+)
+
+type Args struct{ Num1, Num2 int }
+
+type Foo int
+
+func (f Foo) Sum(args Args, reply *int) error {
+	*reply = args.Num1 + args.Num2
+	return nil
+}
+
+type FooV2 int
+
+func (f FooV2) Sum(args Args, reply *int) error {
+	*reply = (args.Num1 + args.Num2) * 2
+	return nil
+}
+
+func startServer(t *testing.T) string {
+	t.Helper()
+	s := server.NewServer()
+	var foo Foo
+	var v2 FooV2
+	if err := s.Register(&foo); err != nil {
+		t.Fatalf("register error: %v", err)
+	}
+	_ = s.RegisterVersion("Bar", "1.0.0", &foo)
+	_ = s.RegisterVersion("Bar", "2.0.0", &v2)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("network error: %v", err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	go s.Accept(l)
+	return "tcp@" + l.Addr().String()
+}
+
+// runCLI runs the command with the flags set, returning what it printed.
+func runCLI(t *testing.T, flags map[string]string, args ...string) (string, error) {
+	t.Helper()
+	for name, value := range flags {
+		if err := flag.Set(name, value); err != nil {
+			t.Fatalf("set -%s: %v", name, err)
+		}
+	}
+	defer func() {
+		for name := range flags {
+			_ = flag.Set(name, flag.Lookup(name).DefValue)
+		}
+	}()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("pipe error: %v", err)
+	}
+	var out bytes.Buffer
+	copied := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(&out, r)
+		close(copied)
+	}()
+	stdout := os.Stdout
+	os.Stdout = w
+	err = run(args)
+	os.Stdout = stdout
+	_ = w.Close()
+	<-copied
+	return out.String(), err
+}
+
+func TestCLI(t *testing.T) {
+	addr := startServer(t)
+	cases := []struct {
+		version string
+		args    []string
+		want    []string
+	}{
+		{"", []string{"list"}, []string{"Bar@1.0.0\n", "Foo\n\tSum(main.Args, *int) error", "Reflection\n"}},
+		// 版本约束不影响内置的反射服务
+		{"^1", []string{"list"}, []string{"Bar@2.0.0\n", "Foo\n"}},
+		{"", []string{"describe", "Foo"}, []string{`"Name": "Foo"`, `"Name": "Sum"`}},
+		{"", []string{"describe", "Bar"}, []string{`"Version": "2.0.0"`}},
+		{"^1", []string{"describe", "Bar"}, []string{`"Version": "1.0.0"`}},
+		{"", []string{"call", "Foo.Sum", `{"Num1": 1, "Num2": 2}`}, []string{"3\n"}},
+		{"^1", []string{"call", "Bar.Sum", `{"Num1": 1, "Num2": 2}`}, []string{"3\n"}},
+		{"^2", []string{"call", "Bar.Sum", `{"Num1": 1, "Num2": 2}`}, []string{"6\n"}},
+	}
+	for _, c := range cases {
+		out, err := runCLI(t, map[string]string{"addr": addr, "version": c.version}, c.args...)
+		if err != nil {
+			t.Errorf("%v -version %q: %v", c.args, c.version, err)
+			continue
+		}
+		for _, want := range c.want {
+			if !strings.Contains(out, want) {
+				t.Errorf("%v -version %q: output lacks %q:\n%s", c.args, c.version, want, out)
+			}
+		}
+	}
+
+	// 错误的参数和不存在的版本
+	for _, c := range []struct {
+		version string
+		args    []string
+	}{
+		{"", []string{"call", "Foo.Sum", "{"}},
+		{"", []string{"describe"}},
+		{"", []string{"nope"}},
+		{"^3", []string{"call", "Bar.Sum", "null"}},
+		{"^3", []string{"describe", "Bar"}},
+	} {
+		if _, err := runCLI(t, map[string]string{"addr": addr, "version": c.version}, c.args...); err == nil {
+			t.Errorf("%v -version %q: expected an error", c.args, c.version)
+		}
+	}
+}
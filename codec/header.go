@@ -2,6 +2,7 @@ package codec
 
 import (
 	"io"
+	"time"
 )
 
 // Header represents the header structure for RPC communication.
@@ -9,6 +10,10 @@ type Header struct {
 	ServiceMethod string // format: "Service.Method"
 	Seq           uint64 // sequence number chosen by client
 	Error         string // error message, empty if no error
+	Version       string // version constraint of the service, empty for any
+	Code          string // status code of an error raised by the server, empty otherwise
+	RetryAfter    time.Duration // how long to wait before retrying a rejected request
+	Metadata      map[string]string // request metadata set by the client
 }
 
 type MsgCodec interface {
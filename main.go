@@ -45,13 +45,14 @@ func startServerNew(registryAddr string, wg *sync.WaitGroup) {
 	log.Println("start http server on", hl.Addr())
 	s := server.NewServer()
 	_ = s.Register(&foo)
-	registry.HeartBeat(registryAddr, "tcp@"+l.Addr().String(), 0)
+	hb := registry.HeartBeatServer(registryAddr, "", s, registry.Instance{Addr: "tcp@" + l.Addr().String()}, 0)
+	s.RegisterOnShutdown(func() { _ = hb.Stop() })
 	// registry.HeartBeat(registryAddr, "tcp@"+hl.Addr().String(), 0)
 	wg.Done()
 
 	mux := http.NewServeMux()
     mux.Handle(server.DefaultRPCPath, s)
-	mux.Handle(server.DefaultDebugPath, server.DebugHTTP{s})
+	mux.Handle(server.DefaultDebugPath, server.DebugHTTP{Server: s})
 
 	go s.Accept(l)
 	go http.Serve(hl, mux)
@@ -76,7 +77,7 @@ func startServer(addr chan string) {
 	// 创建独立的HTTP服务器
     mux := http.NewServeMux()
     mux.Handle(server.DefaultRPCPath, s)
-	mux.Handle(server.DefaultDebugPath, server.DebugHTTP{s})
+	mux.Handle(server.DefaultDebugPath, server.DebugHTTP{Server: s})
 	addr <- l.Addr().String()
 	// server.DefaultServer.Accept(l)
 	
@@ -92,6 +93,8 @@ func foo(xc *xclient.XClient, ctx context.Context, typ, serviceMethod string, ar
 		err = xc.Call(ctx, serviceMethod, args, &reply)
 	case "broadcast":
 		err = xc.Broadcast(ctx, serviceMethod, args, &reply)
+	case "fork":
+		err = xc.Fork(ctx, 0, serviceMethod, args, &reply)
 	}
 	if err != nil {
 		log.Printf("%s %s error: %v", typ, serviceMethod, err)
@@ -127,7 +130,8 @@ func broadcast(addr1, addr2 string) {
 			defer wg.Done()
 			foo(xc, context.Background(), "broadcast", "Foo.Sum", &Args{Num1: i, Num2: i * i})
 			// expect 2 - 5 timeout
-			ctx, _ := context.WithTimeout(context.Background(), time.Second*2)
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+			defer cancel()
 			foo(xc, ctx, "broadcast", "Foo.Sleep", &Args{Num1: i, Num2: i * i})
 		}(i)
 	}
@@ -145,7 +149,8 @@ func newCall(registry string) {
 			defer wg.Done()
 			foo(xc, context.Background(), "broadcast", "Foo.Sum", &Args{Num1: i, Num2: i * i})
 			// expect 2 - 5 timeout
-			ctx, _ := context.WithTimeout(context.Background(), time.Second*2)
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+			defer cancel()
 			foo(xc, ctx, "broadcast", "Foo.Sleep", &Args{Num1: i, Num2: i * i})
 		}(i)
 	}
@@ -163,7 +168,8 @@ func newBroadcast(registry string) {
 			defer wg.Done()
 			foo(xc, context.Background(), "broadcast", "Foo.Sum", &Args{Num1: i, Num2: i * i})
 			// expect 2 - 5 timeout
-			ctx, _ := context.WithTimeout(context.Background(), time.Second*2)
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+			defer cancel()
 			foo(xc, ctx, "broadcast", "Foo.Sleep", &Args{Num1: i, Num2: i * i})
 		}(i)
 	}
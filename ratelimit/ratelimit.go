@@ -0,0 +1,154 @@
+// Package ratelimit implements token buckets used to rate limit calls on
+// both the server and the client.
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// Bucket is a token bucket refilled with rate tokens per second and
+// holding at most burst tokens. Each request takes one token.
+type Bucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	now    func() time.Time
+}
+
+// NewBucket returns a full bucket. A burst below 1 is raised to the rate
+// rounded up, and at least 1.
+func NewBucket(rate float64, burst int) *Bucket {
+	return newBucket(rate, burst, time.Now)
+}
+
+func newBucket(rate float64, burst int, now func() time.Time) *Bucket {
+	b := float64(burst)
+	if b < 1 {
+		b = math.Max(1, math.Ceil(rate))
+	}
+	return &Bucket{rate: rate, burst: b, tokens: b, last: now(), now: now}
+}
+
+// refill adds the tokens accumulated since the last call. Callers must
+// hold b.mu.
+func (b *Bucket) refill() time.Time {
+	now := b.now()
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(b.burst, b.tokens+elapsed*b.rate)
+	}
+	b.last = now
+	return now
+}
+
+// Allow takes a token if one is available. Otherwise it reports how long
+// to wait before one is.
+func (b *Bucket) Allow() (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill()
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, b.delay(1 - b.tokens)
+}
+
+func (b *Bucket) delay(tokens float64) time.Duration {
+	if b.rate <= 0 {
+		return time.Duration(math.MaxInt64)
+	}
+	return time.Duration(math.Ceil(tokens / b.rate * float64(time.Second)))
+}
+
+// Wait takes a token, waiting until one is available or ctx is done.
+func (b *Bucket) Wait(ctx context.Context) error {
+	b.mu.Lock()
+	b.refill()
+	// take the token now, possibly going into debt, so that waiters are
+	// served in order
+	b.tokens--
+	wait := time.Duration(0)
+	if b.tokens < 0 {
+		wait = b.delay(-b.tokens)
+	}
+	b.mu.Unlock()
+	if wait == 0 {
+		return nil
+	}
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+		b.GiveBack()
+		return context.DeadlineExceeded
+	}
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		b.GiveBack()
+		return ctx.Err()
+	}
+}
+
+// GiveBack returns a token taken by Allow that ended up unused.
+func (b *Bucket) GiveBack() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill()
+	b.tokens = math.Min(b.burst, b.tokens+1)
+}
+
+// full reports whether the bucket has refilled completely, so that
+// dropping it loses nothing.
+func (b *Bucket) full() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill()
+	return b.tokens >= b.burst
+}
+
+// maxIdleBuckets is the number of buckets above which Buckets drops the
+// full ones.
+const maxIdleBuckets = 1024
+
+// Buckets is a set of buckets with the same rate and burst, one per key.
+type Buckets struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   int
+	buckets map[string]*Bucket
+	now     func() time.Time
+}
+
+func NewBuckets(rate float64, burst int) *Buckets {
+	return &Buckets{rate: rate, burst: burst, buckets: make(map[string]*Bucket), now: time.Now}
+}
+
+// Get returns the bucket of key, creating it if needed.
+func (bs *Buckets) Get(key string) *Bucket {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	b, ok := bs.buckets[key]
+	if !ok {
+		if len(bs.buckets) >= maxIdleBuckets {
+			for k, b := range bs.buckets {
+				if b.full() {
+					delete(bs.buckets, k)
+				}
+			}
+		}
+		b = newBucket(bs.rate, bs.burst, bs.now)
+		bs.buckets[key] = b
+	}
+	return b
+}
+
+// Allow takes a token from the bucket of key, see Bucket.Allow.
+func (bs *Buckets) Allow(key string) (bool, time.Duration) {
+	return bs.Get(key).Allow()
+}
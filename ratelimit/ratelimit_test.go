@@ -0,0 +1,77 @@
+package ratelimit
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func _assert(t *testing.T, condition bool, msg string, v ...interface{}) {
+	t.Helper()
+	if !condition {
+		t.Errorf("assertion failed: "+msg, v...)
+	}
+}
+
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) now() time.Time { return c.t }
+
+func TestBucket(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(0, 0)}
+	b := newBucket(10, 2, clock.now)
+
+	// 初始可突发burst个请求
+	ok1, _ := b.Allow()
+	ok2, _ := b.Allow()
+	ok3, retry := b.Allow()
+	_assert(t, ok1 && ok2 && !ok3, "unexpected burst: %v %v %v", ok1, ok2, ok3)
+	_assert(t, retry == 100*time.Millisecond, "unexpected retry after: %s", retry)
+
+	// 按速率补充令牌，且不超过burst
+	clock.t = clock.t.Add(50 * time.Millisecond)
+	ok, retry := b.Allow()
+	_assert(t, !ok && retry == 50*time.Millisecond, "allowed too early, retry after %s", retry)
+	clock.t = clock.t.Add(time.Hour)
+	ok1, _ = b.Allow()
+	ok2, _ = b.Allow()
+	ok3, _ = b.Allow()
+	_assert(t, ok1 && ok2 && !ok3, "bucket exceeded its burst: %v %v %v", ok1, ok2, ok3)
+}
+
+func TestBucketWait(t *testing.T) {
+	b := NewBucket(20, 1)
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		err := b.Wait(context.Background())
+		_assert(t, err == nil, "wait error: %v", err)
+	}
+	_assert(t, time.Since(start) >= 90*time.Millisecond, "waited only %s", time.Since(start))
+
+	// 截止时间内等不到令牌时立即返回
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err := b.Wait(ctx)
+	_assert(t, err == context.DeadlineExceeded, "unexpected error: %v", err)
+}
+
+func TestBuckets(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(0, 0)}
+	bs := NewBuckets(1, 1)
+	bs.now = clock.now
+
+	// 每个key独立计数
+	okA, _ := bs.Allow("a")
+	okB, _ := bs.Allow("b")
+	okA2, _ := bs.Allow("a")
+	_assert(t, okA && okB && !okA2, "unexpected results: %v %v %v", okA, okB, okA2)
+
+	// 数量过多时只丢弃已满的桶
+	for i := 0; i < 2*maxIdleBuckets; i++ {
+		bs.Get(strconv.Itoa(i))
+	}
+	_assert(t, len(bs.buckets) <= maxIdleBuckets, "full buckets kept: %d", len(bs.buckets))
+	okA, _ = bs.Allow("a")
+	_assert(t, !okA, "bucket in use was dropped")
+}
@@ -0,0 +1,137 @@
+package registry
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const apiPath = "/v1"
+
+// InstanceStatus is an instance as listed by the JSON API.
+type InstanceStatus struct {
+	Instance
+	LastHeartbeat time.Time `json:"last_heartbeat"`
+}
+
+// APIHandler returns the JSON API of the registry, meant for tools and
+// clients not written in Go. Paths are relative to where it is mounted,
+// HandleHTTP mounts it under "/v1":
+//
+//	GET    /instances?service=&version=  list the alive instances
+//	GET    /services                      list the names of the services offered
+//	GET    /services/{name}?version=      list the instances offering a service
+//	POST   /instances                     register or renew an instance
+//	DELETE /instances/{addr}              deregister an instance
+//
+// Errors are returned as {"error": "..."}. The tokens of SetTokens apply as
+// for the header protocol. Lookups of instances support the blocking
+// parameters index and wait of the header protocol.
+func (r *GoRegistry) APIHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /instances", r.listInstances)
+	mux.HandleFunc("GET /services", r.listServices)
+	mux.HandleFunc("GET /services/{name}", r.getService)
+	mux.HandleFunc("POST /instances", r.registerInstance)
+	mux.HandleFunc("DELETE /instances/{addr}", r.deregisterInstance)
+	mux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
+		notFound(mux, w, req)
+	})
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !r.allowed(req) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		mux.ServeHTTP(w, req)
+	})
+}
+
+// notFound replies to requests no route of mux matches: 405 Method Not
+// Allowed if the path is served with other methods, 404 Not Found otherwise.
+func notFound(mux *http.ServeMux, w http.ResponseWriter, req *http.Request) {
+	var allow []string
+	for _, method := range []string{"GET", "POST", "DELETE"} {
+		probe := req.Clone(req.Context())
+		probe.Method = method
+		if _, pattern := mux.Handler(probe); pattern != "/" {
+			allow = append(allow, method)
+		}
+	}
+	if len(allow) == 0 {
+		writeError(w, http.StatusNotFound, "not found: "+req.URL.Path)
+		return
+	}
+	w.Header().Set("Allow", strings.Join(allow, ", "))
+	writeError(w, http.StatusMethodNotAllowed, "method not allowed: "+req.Method)
+}
+
+// writeStatuses replies with the alive instances offering service, empty
+// for all, after blocking as requested by req.
+func (r *GoRegistry) writeStatuses(w http.ResponseWriter, req *http.Request, service string) {
+	if err := r.block(req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	items, index := r.aliveItems(service, req.URL.Query().Get("version"))
+	list := make([]InstanceStatus, len(items))
+	for i, s := range items {
+		list[i] = InstanceStatus{Instance: s.Instance, LastHeartbeat: s.start}
+	}
+	w.Header().Set(IndexHeader, strconv.FormatUint(index, 10))
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (r *GoRegistry) listInstances(w http.ResponseWriter, req *http.Request) {
+	r.writeStatuses(w, req, req.URL.Query().Get("service"))
+}
+
+func (r *GoRegistry) listServices(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, http.StatusOK, r.serviceNames())
+}
+
+func (r *GoRegistry) getService(w http.ResponseWriter, req *http.Request) {
+	r.writeStatuses(w, req, req.PathValue("name"))
+}
+
+func (r *GoRegistry) registerInstance(w http.ResponseWriter, req *http.Request) {
+	var inst Instance
+	if err := json.NewDecoder(req.Body).Decode(&inst); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid instance: "+err.Error())
+		return
+	}
+	if inst.Addr == "" {
+		writeError(w, http.StatusBadRequest, "addr is required")
+		return
+	}
+	if inst.Weight < 0 {
+		writeError(w, http.StatusBadRequest, "weight must not be negative")
+		return
+	}
+	s := r.putServer(inst)
+	log.Println("put server:", inst.Addr)
+	writeJSON(w, http.StatusOK, InstanceStatus{Instance: s.Instance, LastHeartbeat: s.start})
+}
+
+func (r *GoRegistry) deregisterInstance(w http.ResponseWriter, req *http.Request) {
+	addr := req.PathValue("addr")
+	if !r.removeServer(addr) {
+		writeError(w, http.StatusNotFound, "unknown instance "+addr)
+		return
+	}
+	log.Println("remove server:", addr)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
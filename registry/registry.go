@@ -1,11 +1,19 @@
 package registry
 
 import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"gorpc/server"
 	"time"
 	"sync"
 	"sort"
 	"net/http"
 	"log"
+	"reflect"
+	"strconv"
 	"strings"
 )
 
@@ -13,10 +21,66 @@ type GoRegistry struct {
 	timeout time.Duration
 	mu sync.Mutex
 	servers map[string]*ServerItem
+	services map[string]map[string]*ServerItem // servers by service name, "" for those advertising none
+	index uint64 // revision of the servers, bumped on every change
+	changed chan struct{} // closed and replaced on every change
+	store *fileStore // nil unless persisted, see SetStore
+	writeToken string
+	readToken string
+}
+
+// Instance describes a registered server.
+type Instance struct {
+	Addr string `json:"addr"`
+	Services []string `json:"services,omitempty"` // services offered, as "name" or "name@version"
+	Weight int `json:"weight,omitempty"` // relative share of the calls, 0 for the default of 1
+	Zone string `json:"zone,omitempty"`
+	Version string `json:"version,omitempty"` // version of the server itself
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// Offers reports whether the instance offers a version of service
+// satisfying the constraint version. Instances that advertise no services
+// are assumed to offer every service, unversioned.
+func (inst *Instance) Offers(service, version string) bool {
+	if len(inst.Services) == 0 {
+		return version == ""
+	}
+	// as on the server, version does not apply to services published
+	// without versions
+	var unversioned, versioned bool
+	for _, svc := range inst.Services {
+		name, ver, _ := strings.Cut(svc, "@")
+		if name != service {
+			continue
+		}
+		if version == "" || (ver != "" && server.MatchVersion(ver, version)) {
+			return true
+		}
+		if ver == "" {
+			unversioned = true
+		} else {
+			versioned = true
+		}
+	}
+	return unversioned && !versioned
+}
+
+// serviceNames returns the names of the services offered by inst, without
+// versions, or "" if it advertises none.
+func (inst *Instance) serviceNames() []string {
+	if len(inst.Services) == 0 {
+		return []string{""}
+	}
+	names := make([]string, len(inst.Services))
+	for i, svc := range inst.Services {
+		names[i], _, _ = strings.Cut(svc, "@")
+	}
+	return names
 }
 
 type ServerItem struct {
-	Addr string
+	Instance
 	start time.Time
 }
 
@@ -28,60 +92,251 @@ const (
 func NewGoRegistry(timeout time.Duration) *GoRegistry {
 	return &GoRegistry{
 		servers: make(map[string]*ServerItem),
+		services: make(map[string]map[string]*ServerItem),
+		index: 1,
+		changed: make(chan struct{}),
 		timeout: timeout,
 	}
 }
 
 var DefaultGoRegistry = NewGoRegistry(defaultTimeout)
 
-func (r *GoRegistry) putServer(addr string) {
+// SetTokens makes the registry require the bearer token write on
+// heartbeats, and the bearer token read on lookups unless read is empty.
+// Requests without the token are rejected with 401 Unauthorized. It must
+// be called before the registry is used.
+func (r *GoRegistry) SetTokens(write, read string) {
+	r.writeToken = write
+	r.readToken = read
+}
+
+// authorized reports whether req carries token, or token is empty.
+func authorized(req *http.Request, token string) bool {
+	if token == "" {
+		return true
+	}
+	got, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
+
+func (r *GoRegistry) putServer(inst Instance) ServerItem {
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	s, ok := r.servers[addr]
+	old, ok := r.servers[inst.Addr]
 	if ok {
-		s.start = time.Now()
-	} else {
-		r.servers[addr] = &ServerItem{
-			Addr: addr,
-			start: time.Now(),
+		r.unindex(old)
+	}
+	if !ok || !reflect.DeepEqual(old.Instance, inst) {
+		r.bump()
+	}
+	s := &ServerItem{
+		Instance: inst,
+		start: time.Now(),
+	}
+	r.put(s)
+	r.persist("put", s)
+	return *s
+}
+
+// put adds s to the servers and the service index. Callers must hold r.mu.
+func (r *GoRegistry) put(s *ServerItem) {
+	r.servers[s.Addr] = s
+	for _, name := range s.serviceNames() {
+		if r.services[name] == nil {
+			r.services[name] = make(map[string]*ServerItem)
 		}
+		r.services[name][s.Addr] = s
 	}
 }
 
-func (r *GoRegistry) aliveServers() []string {
+// removeServer removes addr, reporting whether it was registered.
+func (r *GoRegistry) removeServer(addr string) bool {
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	var alive []string
+	return r.remove(addr)
+}
+
+// remove removes addr from the servers and the service index. Callers must
+// hold r.mu.
+func (r *GoRegistry) remove(addr string) bool {
+	s, ok := r.servers[addr]
+	if !ok {
+		return false
+	}
+	r.unindex(s)
+	r.bump()
+	r.persist("remove", s)
+	return true
+}
+
+// unindex removes s from the servers and the service index. Callers must
+// hold r.mu.
+func (r *GoRegistry) unindex(s *ServerItem) {
+	delete(r.servers, s.Addr)
+	for _, name := range s.serviceNames() {
+		delete(r.services[name], s.Addr)
+		if len(r.services[name]) == 0 {
+			delete(r.services, name)
+		}
+	}
+}
+
+func (r *GoRegistry) alive(s *ServerItem) bool {
+	return r.timeout == 0 || s.start.Add(r.timeout).After(time.Now())
+}
+
+// aliveItems returns the servers that are alive and, if service is not
+// empty, offer a version of it satisfying the constraint version, sorted
+// by address, and the index of the servers. Expired servers are removed.
+func (r *GoRegistry) aliveItems(service, version string) ([]ServerItem, uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sweep()
+	candidates := []map[string]*ServerItem{r.servers}
+	if service != "" {
+		candidates = []map[string]*ServerItem{r.services[service], r.services[""]}
+	}
+	alive := make([]ServerItem, 0)
+	for _, servers := range candidates {
+		for _, s := range servers {
+			if service == "" || s.Offers(service, version) {
+				alive = append(alive, *s)
+			}
+		}
+	}
+	sort.Slice(alive, func(i, j int) bool {
+		return alive[i].Addr < alive[j].Addr
+	})
+	return alive, r.index
+}
+
+// sweep removes the expired servers. Callers must hold r.mu.
+func (r *GoRegistry) sweep() {
 	for addr, s := range r.servers {
-		if r.timeout == 0 || s.start.Add(r.timeout).After(time.Now()) {
-			alive = append(alive, addr)
-		} else {
-			delete(r.servers, addr)
+		if !r.alive(s) {
+			r.remove(addr)
+		}
+	}
+}
+
+// serviceNames returns the sorted names of the services offered by alive
+// servers.
+func (r *GoRegistry) serviceNames() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	names := make([]string, 0, len(r.services))
+	for name, servers := range r.services {
+		for _, s := range servers {
+			if name != "" && r.alive(s) {
+				names = append(names, name)
+				break
+			}
 		}
 	}
-	sort.Strings(alive)
+	sort.Strings(names)
+	return names
+}
+
+func (r *GoRegistry) aliveInstances(service, version string) []Instance {
+	items, _ := r.aliveItems(service, version)
+	alive := make([]Instance, len(items))
+	for i, s := range items {
+		alive[i] = s.Instance
+	}
+	return alive
+}
+
+func (r *GoRegistry) aliveServers(service, version string) []string {
+	var alive []string
+	for _, inst := range r.aliveInstances(service, version) {
+		alive = append(alive, inst.Addr)
+	}
 	return alive
 }
 
+// checkToken replies 401 Unauthorized and returns false unless req carries
+// the read token for GET requests, the write token for the others.
+func (r *GoRegistry) checkToken(w http.ResponseWriter, req *http.Request) bool {
+	if !r.allowed(req) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		w.WriteHeader(http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// allowed reports whether req carries the token required by its method.
+func (r *GoRegistry) allowed(req *http.Request) bool {
+	token := r.writeToken
+	if req.Method == "GET" {
+		token = r.readToken
+	}
+	return authorized(req, token)
+}
+
 func (r *GoRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request){
+	if !r.checkToken(w, req) {
+		return
+	}
 	switch req.Method {
 	case "GET":
-		w.Header().Set("X-GoRPC-Servers", strings.Join(r.aliveServers(), ","))
+		// the addresses are sent in the header for older clients, the
+		// instances with their metadata as JSON in the body
+		if err := r.block(req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		query := req.URL.Query()
+		items, index := r.aliveItems(query.Get("service"), query.Get("version"))
+		alive := make([]Instance, len(items))
+		addrs := make([]string, len(items))
+		for i, s := range items {
+			alive[i] = s.Instance
+			addrs[i] = s.Addr
+		}
+		w.Header().Set("X-GoRPC-Servers", strings.Join(addrs, ","))
+		w.Header().Set(IndexHeader, strconv.FormatUint(index, 10))
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(alive)
 	case "POST":
+		// heartbeats carry the instance as JSON, older ones only headers
+		inst := Instance{
+			Addr: req.Header.Get("X-GoRPC-Server"),
+			Services: splitList(req.Header.Get("X-GoRPC-Services")),
+		}
+		if strings.HasPrefix(req.Header.Get("Content-Type"), "application/json") {
+			if err := json.NewDecoder(req.Body).Decode(&inst); err != nil {
+				http.Error(w, "invalid instance: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if inst.Addr == "" || inst.Weight < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		r.putServer(inst)
+		log.Println("put server:", inst.Addr)
+	case "DELETE":
 		addr := req.Header.Get("X-GoRPC-Server")
 		if addr == "" {
-			w.WriteHeader(http.StatusInternalServerError)
+			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
-		r.putServer(addr)
-		log.Println("put server:", addr)
+		if !r.removeServer(addr) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		log.Println("remove server:", addr)
 	default:
 		w.WriteHeader(http.StatusMethodNotAllowed)
 	}
 }
 
+// HandleHTTP serves the registry on registryPath, and its JSON API on
+// registryPath + "/v1/".
 func (r *GoRegistry) HandleHTTP(registryPath string) {
 	http.Handle(registryPath, r)
+	http.Handle(registryPath+apiPath+"/", http.StripPrefix(registryPath+apiPath, r.APIHandler()))
 	log.Println("rpc registry path:", registryPath)
 }
 
@@ -89,29 +344,174 @@ func HandleHTTP() {
 	DefaultGoRegistry.HandleHTTP(defaultPath)
 }
 
-func HeartBeat(registry, addr string, duration time.Duration) {
+func splitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// Heartbeat keeps a server registered until it is stopped.
+type Heartbeat struct {
+	registry string
+	token string
+	addr string
+	ctx context.Context
+	cancel context.CancelFunc // stops the heartbeats and aborts the one in flight
+	done chan struct{} // closed when the heartbeat goroutine exits
+	once sync.Once
+}
+
+// HeartBeat registers addr on the registry and keeps it alive. services
+// lists the services the server offers, as "name" or "name@version", so
+// that clients can look up servers by service and version. Stopping the
+// returned heartbeat deregisters the server, for instance on shutdown:
+//
+//	hb := registry.HeartBeat(registryAddr, addr, 0)
+//	s.RegisterOnShutdown(func() { _ = hb.Stop() })
+func HeartBeat(registry, addr string, duration time.Duration, services ...string) *Heartbeat {
+	return HeartBeatWithToken(registry, "", addr, duration, services...)
+}
+
+// HeartBeatWithToken is like HeartBeat for registries requiring the bearer
+// token on heartbeats, see GoRegistry.SetTokens.
+func HeartBeatWithToken(registry, token, addr string, duration time.Duration, services ...string) *Heartbeat {
+	return HeartBeatInstance(registry, token, Instance{Addr: addr, Services: services}, duration)
+}
+
+// HeartBeatInstance is like HeartBeatWithToken, registering the instance
+// with its metadata. token may be empty.
+func HeartBeatInstance(registry, token string, inst Instance, duration time.Duration) *Heartbeat {
+	return heartBeat(registry, token, inst.Addr, duration, func() Instance { return inst })
+}
+
+// HeartBeatServer is like HeartBeatInstance, publishing the services
+// registered on s as the services of the instance. Every heartbeat sends
+// the current services, so services registered or unregistered later are
+// picked up by the registry. token may be empty:
+//
+//	hb := registry.HeartBeatServer(registryAddr, "", s, registry.Instance{Addr: addr}, 0)
+//	s.RegisterOnShutdown(func() { _ = hb.Stop() })
+func HeartBeatServer(registry, token string, s *server.Server, inst Instance, duration time.Duration) *Heartbeat {
+	return heartBeat(registry, token, inst.Addr, duration, func() Instance {
+		i := inst
+		i.Services = s.ServiceNames()
+		return i
+	})
+}
+
+func heartBeat(registry, token, addr string, duration time.Duration, instance func() Instance) *Heartbeat {
 	if duration == 0 {
 		duration = defaultTimeout - time.Duration(1)*time.Minute
 	}
-	var err error
-	err = sendHeartbeat(registry, addr)
+	h := &Heartbeat{
+		registry: registry,
+		token: token,
+		addr: addr,
+		done: make(chan struct{}),
+	}
+	h.ctx, h.cancel = context.WithCancel(context.Background())
+	err := sendHeartbeat(h.ctx, registry, token, instance())
 	go func(){
-		ticker := time.NewTicker(duration)
-		for err == nil {
-			<- ticker.C
-			err = sendHeartbeat(registry, addr)
+		defer close(h.done)
+		// failed heartbeats are retried sooner, backing off up to the
+		// heartbeat interval, until the heartbeat is stopped
+		retry := heartbeatRetry
+		next := func(err error) time.Duration {
+			if err == nil {
+				retry = heartbeatRetry
+				return duration
+			}
+			wait := min(retry, duration)
+			retry *= 2
+			return wait
+		}
+		timer := time.NewTimer(next(err))
+		defer timer.Stop()
+		for {
+			select {
+			case <- timer.C:
+				timer.Reset(next(sendHeartbeat(h.ctx, registry, token, instance())))
+			case <- h.ctx.Done():
+				return
+			}
 		}
 	}()
+	return h
 }
 
-func sendHeartbeat(registry, addr string) error {
-	log.Println(addr, "send heart beat to registry", registry)
-	httpClient := &http.Client{}
-	req, _ := http.NewRequest("POST", registry, nil)
-	req.Header.Set("X-GoRPC-Server", addr)
-	if _, err := httpClient.Do(req); err != nil {
+// Stop stops sending heartbeats and deregisters the server, so that
+// clients stop using it without waiting for it to expire. It waits for the
+// heartbeat in flight, if any, to be aborted first, so that it cannot
+// register the server again.
+func (h *Heartbeat) Stop() error {
+	var err error
+	h.once.Do(func() {
+		h.cancel()
+		<-h.done
+		err = DeregisterWithToken(h.registry, h.token, h.addr)
+	})
+	return err
+}
+
+// Deregister removes addr from the registry.
+func Deregister(registry, addr string) error {
+	return DeregisterWithToken(registry, "", addr)
+}
+
+// DeregisterWithToken is like Deregister for registries requiring the
+// bearer token on heartbeats.
+func DeregisterWithToken(registry, token, addr string) error {
+	log.Println(addr, "deregister from registry", registry)
+	if err := send(context.Background(), "DELETE", registry, token, Instance{Addr: addr}); err != nil {
+		log.Println("rpc server: deregister err:", err)
+		return err
+	}
+	return nil
+}
+
+func sendHeartbeat(ctx context.Context, registry, token string, inst Instance) error {
+	log.Println(inst.Addr, "send heart beat to registry", registry)
+	if err := send(ctx, "POST", registry, token, inst); err != nil {
 		log.Println("rpc server: heart beat err:", err)
 		return err
 	}
 	return nil
+}
+
+const (
+	registryTimeout = 10 * time.Second // bounds the requests sent to the registry
+	heartbeatRetry = time.Second // first retry of a failed heartbeat
+)
+
+func send(ctx context.Context, method, registry, token string, inst Instance) error {
+	httpClient := &http.Client{Timeout: registryTimeout}
+	body, err := json.Marshal(inst)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, registry, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-GoRPC-Server", inst.Addr)
+	if len(inst.Services) > 0 {
+		req.Header.Set("X-GoRPC-Services", strings.Join(inst.Services, ","))
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
 }
\ No newline at end of file
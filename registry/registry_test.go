@@ -0,0 +1,370 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gorpc/server"
+)
+
+func _assert(t *testing.T, condition bool, msg string, v ...interface{}) {
+	t.Helper()
+	if !condition {
+		t.Errorf("assertion failed: "+msg, v...)
+	}
+}
+
+func get(t *testing.T, url, token string) *http.Response {
+	t.Helper()
+	req, _ := http.NewRequest("GET", url, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("get error: %v", err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestTokens(t *testing.T) {
+	r := NewGoRegistry(time.Minute)
+	r.SetTokens("write", "read")
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	// 没有令牌或令牌错误的心跳被拒绝
+	err := sendHeartbeat(context.Background(), ts.URL, "", Instance{Addr: "tcp@a:1"})
+	_assert(t, err != nil, "heartbeat without token accepted")
+	err = sendHeartbeat(context.Background(), ts.URL, "read", Instance{Addr: "tcp@a:1"})
+	_assert(t, err != nil, "heartbeat with read token accepted")
+	err = sendHeartbeat(context.Background(), ts.URL, "write", Instance{Addr: "tcp@b:1"})
+	_assert(t, err == nil, "heartbeat error: %v", err)
+
+	// 查询需要读令牌
+	resp := get(t, ts.URL, "")
+	_assert(t, resp.StatusCode == http.StatusUnauthorized, "unexpected status %s", resp.Status)
+	resp = get(t, ts.URL, "read")
+	servers := resp.Header.Get("X-GoRPC-Servers")
+	_assert(t, resp.StatusCode == http.StatusOK && servers == "tcp@b:1", "unexpected servers %q (%s)", servers, resp.Status)
+
+	// 未设置读令牌时查询公开
+	r2 := NewGoRegistry(time.Minute)
+	r2.SetTokens("write", "")
+	ts2 := httptest.NewServer(r2)
+	defer ts2.Close()
+	resp = get(t, ts2.URL, "")
+	_assert(t, resp.StatusCode == http.StatusOK, "unexpected status %s", resp.Status)
+}
+
+func TestDeregister(t *testing.T) {
+	r := NewGoRegistry(time.Minute)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	HeartBeat(ts.URL, "tcp@a:1", time.Minute)
+	hb := HeartBeat(ts.URL, "tcp@b:1", time.Minute)
+	_assert(t, len(r.aliveServers("", "")) == 2, "servers not registered")
+
+	err := Deregister(ts.URL, "tcp@a:1")
+	_assert(t, err == nil, "deregister error: %v", err)
+	err = Deregister(ts.URL, "tcp@a:1")
+	_assert(t, err != nil, "expected error deregistering twice")
+
+	// 服务器优雅关闭时通过Stop注销
+	s := server.NewServer()
+	s.RegisterOnShutdown(func() {
+		err := hb.Stop()
+		_assert(t, err == nil, "stop error: %v", err)
+	})
+	_ = s.Shutdown(context.Background())
+	alive := r.aliveServers("", "")
+	_assert(t, len(alive) == 0, "servers left after shutdown: %v", alive)
+	_assert(t, hb.Stop() == nil, "second stop failed")
+}
+
+func TestInstanceMetadata(t *testing.T) {
+	r := NewGoRegistry(time.Minute)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	inst := Instance{
+		Addr:     "tcp@a:1",
+		Services: []string{"Foo@1.0.0"},
+		Weight:   3,
+		Zone:     "us-east-1a",
+		Version:  "v1.4.2",
+		Labels:   map[string]string{"canary": "true"},
+	}
+	HeartBeatInstance(ts.URL, "", inst, time.Minute)
+	HeartBeat(ts.URL, "tcp@b:1", time.Minute)
+
+	// 元数据以JSON返回，旧的头部协议同时保留
+	resp, err := http.Get(ts.URL + "?service=Foo&version=^1")
+	if err != nil {
+		t.Fatalf("get error: %v", err)
+	}
+	defer resp.Body.Close()
+	var got []Instance
+	err = json.NewDecoder(resp.Body).Decode(&got)
+	_assert(t, err == nil && len(got) == 1, "unexpected instances %+v, err %v", got, err)
+	_assert(t, got[0].Weight == 3 && got[0].Zone == "us-east-1a" && got[0].Labels["canary"] == "true",
+		"metadata lost: %+v", got[0])
+	_assert(t, resp.Header.Get("X-GoRPC-Servers") == "tcp@a:1", "unexpected header %q", resp.Header.Get("X-GoRPC-Servers"))
+
+	resp = get(t, ts.URL, "")
+	_assert(t, resp.Header.Get("X-GoRPC-Servers") == "tcp@a:1,tcp@b:1", "unexpected header %q", resp.Header.Get("X-GoRPC-Servers"))
+}
+
+func TestAPI(t *testing.T) {
+	r := NewGoRegistry(time.Minute)
+	r.SetTokens("write", "")
+	mux := http.NewServeMux()
+	mux.Handle("/registry", r)
+	mux.Handle("/registry/v1/", http.StripPrefix("/registry/v1", r.APIHandler()))
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	api := ts.URL + "/registry/v1"
+
+	do := func(method, url, token, body string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(method, url, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s error: %v", method, err)
+		}
+		return resp
+	}
+	list := func(url string) []InstanceStatus {
+		t.Helper()
+		resp := do("GET", url, "", "")
+		defer resp.Body.Close()
+		var got []InstanceStatus
+		if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+			t.Fatalf("decode error: %v", err)
+		}
+		return got
+	}
+
+	// 注册需要写令牌，所有错误都以JSON返回
+	apiError := func(resp *http.Response, status int) {
+		t.Helper()
+		defer resp.Body.Close()
+		var apiErr struct{ Error string }
+		_ = json.NewDecoder(resp.Body).Decode(&apiErr)
+		_assert(t, resp.StatusCode == status && apiErr.Error != "", "unexpected response %s %+v", resp.Status, apiErr)
+	}
+	apiError(do("POST", api+"/instances", "", `{"addr": "tcp@a:1"}`), http.StatusUnauthorized)
+	apiError(do("POST", api+"/instances", "write", `{"weight": 1}`), http.StatusBadRequest)
+	apiError(do("GET", api+"/instances?index=x", "", ""), http.StatusBadRequest)
+	apiError(do("GET", api+"/nothing", "", ""), http.StatusNotFound)
+	resp := do("PUT", api+"/instances", "write", "")
+	_assert(t, resp.Header.Get("Allow") == "GET, POST", "unexpected Allow %q", resp.Header.Get("Allow"))
+	apiError(resp, http.StatusMethodNotAllowed)
+
+	before := time.Now()
+	resp = do("POST", api+"/instances", "write", `{"addr": "tcp@a:1", "services": ["Foo@1.2.0"], "zone": "z1"}`)
+	_assert(t, resp.StatusCode == http.StatusOK, "unexpected status %s", resp.Status)
+	HeartBeatWithToken(ts.URL+"/registry", "write", "tcp@b:1", time.Minute, "Bar")
+
+	// 列表包含元数据和最后一次心跳时间，新旧协议共享同一份数据
+	all := list(api + "/instances")
+	_assert(t, len(all) == 2 && all[0].Addr == "tcp@a:1" && all[0].Zone == "z1", "unexpected instances %+v", all)
+	_assert(t, !all[0].LastHeartbeat.Before(before.Truncate(time.Second)), "unexpected heartbeat time %v", all[0].LastHeartbeat)
+	foo := list(api + "/services/Foo?version=^1")
+	_assert(t, len(foo) == 1 && foo[0].Addr == "tcp@a:1", "unexpected Foo instances %+v", foo)
+	_assert(t, len(list(api+"/services/Foo?version=^2")) == 0, "Foo 2 should have no instances")
+
+	// 注销
+	resp = do("DELETE", api+"/instances/tcp@a:1", "write", "")
+	_assert(t, resp.StatusCode == http.StatusNoContent, "unexpected status %s", resp.Status)
+	resp = do("DELETE", api+"/instances/tcp@a:1", "write", "")
+	_assert(t, resp.StatusCode == http.StatusNotFound, "unexpected status %s", resp.Status)
+	resp = get(t, ts.URL+"/registry", "")
+	_assert(t, resp.Header.Get("X-GoRPC-Servers") == "tcp@b:1", "unexpected header %q", resp.Header.Get("X-GoRPC-Servers"))
+}
+
+type Foo int
+
+func (f Foo) Sum(args [2]int, reply *int) error {
+	*reply = args[0] + args[1]
+	return nil
+}
+
+func TestHeartBeatServer(t *testing.T) {
+	r := NewGoRegistry(time.Minute)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	s := server.NewServer()
+	var foo Foo
+	_ = s.Register(&foo)
+	hb := HeartBeatServer(ts.URL, "", s, Instance{Addr: "tcp@a:1", Zone: "z1"}, 10*time.Millisecond)
+	defer hb.Stop()
+	HeartBeat(ts.URL, "tcp@b:1", time.Minute)
+	HeartBeat(ts.URL, "tcp@c:1", time.Minute, "Bar@1.0.0")
+
+	// 按服务索引，未声明服务的旧服务器提供所有服务
+	foos := r.aliveServers("Foo", "")
+	_assert(t, len(foos) == 2 && foos[0] == "tcp@a:1" && foos[1] == "tcp@b:1", "unexpected Foo servers %v", foos)
+	bars := r.aliveServers("Bar", "^1")
+	_assert(t, len(bars) == 1 && bars[0] == "tcp@c:1", "unexpected Bar servers %v", bars)
+	_assert(t, r.aliveInstances("Foo", "")[0].Zone == "z1", "metadata lost")
+
+	// 之后注册的服务随下一次心跳发布
+	_ = s.RegisterVersion("Baz", "1.0.0", &foo)
+	time.Sleep(50 * time.Millisecond)
+	bazs := r.aliveServers("Baz", "1.0")
+	_assert(t, len(bazs) == 1 && bazs[0] == "tcp@a:1", "unexpected Baz servers %v", bazs)
+	// 版本约束不作用于未带版本发布的服务
+	healths := r.aliveServers(server.HealthService, "^1")
+	_assert(t, len(healths) == 1 && healths[0] == "tcp@a:1", "unexpected Health servers %v", healths)
+	names := strings.Join(r.serviceNames(), ",")
+	_assert(t, strings.Contains(names, "Bar,Baz,Foo"), "unexpected services %s", names)
+
+	// 重新注册后旧的索引被清除
+	HeartBeat(ts.URL, "tcp@c:1", time.Minute, "Qux")
+	bars = r.aliveServers("Bar", "")
+	_assert(t, len(bars) == 1 && bars[0] == "tcp@b:1", "stale Bar index %v", bars)
+}
+
+func TestWatch(t *testing.T) {
+	r := NewGoRegistry(200 * time.Millisecond)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	lookup := func(query string) (string, string, time.Duration) {
+		t.Helper()
+		start := time.Now()
+		resp := get(t, ts.URL+query, "")
+		return resp.Header.Get(IndexHeader), resp.Header.Get("X-GoRPC-Servers"), time.Since(start)
+	}
+	index, _, _ := lookup("")
+
+	// 没有变化时阻塞到等待时间结束
+	got, _, elapsed := lookup("?index=" + index + "&wait=50ms")
+	_assert(t, got == index && elapsed >= 50*time.Millisecond, "index %s after %v", got, elapsed)
+
+	// 注册时立即返回
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		_ = sendHeartbeat(context.Background(), ts.URL, "", Instance{Addr: "tcp@a:1"})
+	}()
+	got, servers, elapsed := lookup("?index=" + index + "&wait=10s")
+	_assert(t, got != index && servers == "tcp@a:1" && elapsed < time.Second, "index %s servers %q after %v", got, servers, elapsed)
+
+	// 内容不变的心跳不算变化，过期算变化
+	_ = sendHeartbeat(context.Background(), ts.URL, "", Instance{Addr: "tcp@a:1"})
+	index = got
+	got, servers, elapsed = lookup("?index=" + index + "&wait=10s")
+	_assert(t, got != index && servers == "" && elapsed >= 150*time.Millisecond && elapsed < time.Second,
+		"index %s servers %q after %v", got, servers, elapsed)
+
+	resp := get(t, ts.URL+"?index=x", "")
+	_assert(t, resp.StatusCode == http.StatusBadRequest, "unexpected status %s", resp.Status)
+}
+
+func TestStore(t *testing.T) {
+	dir := t.TempDir()
+	r := NewGoRegistry(300 * time.Millisecond)
+	if err := r.SetStore(dir); err != nil {
+		t.Fatalf("set store error: %v", err)
+	}
+	r.putServer(Instance{Addr: "tcp@a:1", Services: []string{"Foo@1.0.0"}, Weight: 2})
+	r.putServer(Instance{Addr: "tcp@b:1"})
+	r.removeServer("tcp@b:1")
+	_ = r.Close()
+	time.Sleep(150 * time.Millisecond)
+
+	// 重启后恢复实例及元数据，剩余的存活时间不变
+	r = NewGoRegistry(300 * time.Millisecond)
+	if err := r.SetStore(dir); err != nil {
+		t.Fatalf("restore error: %v", err)
+	}
+	alive := r.aliveInstances("Foo", "^1")
+	_assert(t, len(alive) == 1 && alive[0].Addr == "tcp@a:1" && alive[0].Weight == 2, "unexpected instances %+v", alive)
+	time.Sleep(200 * time.Millisecond)
+	_assert(t, len(r.aliveServers("", "")) == 0, "instance outlived its TTL")
+	_ = r.Close()
+
+	// 日志超过阈值时压缩，写了一半的日志项被忽略
+	r = NewGoRegistry(time.Minute)
+	if err := r.SetStore(dir); err != nil {
+		t.Fatalf("set store error: %v", err)
+	}
+	for i := 0; i < compactThreshold+10; i++ {
+		r.putServer(Instance{Addr: "tcp@c:" + strconv.Itoa(i%3)})
+	}
+	_ = r.Close()
+	b, _ := os.ReadFile(filepath.Join(dir, logFile))
+	_assert(t, strings.Count(string(b), "\n") < compactThreshold, "log not compacted")
+	f, _ := os.OpenFile(filepath.Join(dir, logFile), os.O_WRONLY|os.O_APPEND, 0o644)
+	_, _ = f.WriteString(`{"op":"remove","addr":"tcp@c:0"}` + "\n" + `{"op":"put","addr":"tcp@d`)
+	_ = f.Close()
+
+	r = NewGoRegistry(time.Minute)
+	if err := r.SetStore(dir); err != nil {
+		t.Fatalf("restore error: %v", err)
+	}
+	defer r.Close()
+	servers := strings.Join(r.aliveServers("", ""), ",")
+	_assert(t, servers == "tcp@c:1,tcp@c:2", "unexpected servers %q", servers)
+}
+
+func TestHeartBeatRetry(t *testing.T) {
+	r := NewGoRegistry(time.Minute)
+	var mu sync.Mutex
+	failures := 2
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		fail := req.Method == "POST" && failures > 0
+		if fail {
+			failures--
+		}
+		mu.Unlock()
+		if fail {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		r.ServeHTTP(w, req)
+	}))
+	defer ts.Close()
+
+	// 心跳失败后继续重试，直到Stop
+	hb := HeartBeat(ts.URL, "tcp@a:1", 20*time.Millisecond)
+	for i := 0; i < 100 && len(r.aliveServers("", "")) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	_assert(t, len(r.aliveServers("", "")) == 1, "heartbeats stopped after failures")
+	_ = hb.Stop()
+	_assert(t, len(r.aliveServers("", "")) == 0, "server left after stop")
+}
+
+func TestHeartBeatStop(t *testing.T) {
+	r := NewGoRegistry(time.Minute)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	// Stop等待正在发送的心跳结束后才注销，之后不会被重新注册
+	for i := 0; i < 50; i++ {
+		hb := HeartBeat(ts.URL, "tcp@a:1", time.Millisecond)
+		time.Sleep(time.Duration(i%5) * time.Millisecond)
+		_ = hb.Stop()
+		time.Sleep(2 * time.Millisecond)
+		_assert(t, len(r.aliveServers("", "")) == 0, "server registered again after stop (run %d)", i)
+	}
+}
@@ -0,0 +1,211 @@
+package registry
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+const (
+	snapshotFile = "snapshot.json"
+	logFile = "log.jsonl"
+	compactThreshold = 1024 // log entries written before the log is compacted
+)
+
+// logEntry is a change of the servers appended to the log: op is "put"
+// for heartbeats, "remove" for deregistrations and expirations.
+type logEntry struct {
+	Op string `json:"op"`
+	InstanceStatus
+}
+
+// fileStore persists the servers of a registry in a directory, as a
+// snapshot and a log of the changes made since the snapshot was written.
+type fileStore struct {
+	dir string
+	log *os.File
+	entries int
+}
+
+// SetStore makes the registry persist its servers in the directory dir,
+// created if needed. Servers saved there by a previous run and not expired
+// yet are restored with the time left before they expire, so that clients
+// find them as soon as the registry restarts. It must be called before
+// the registry is used.
+func (r *GoRegistry) SetStore(dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	st := &fileStore{dir: dir}
+	statuses, err := st.load()
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, status := range statuses {
+		s := &ServerItem{Instance: status.Instance, start: status.LastHeartbeat}
+		if r.alive(s) {
+			r.put(s)
+		}
+	}
+	r.bump()
+	// start over from a snapshot of what was restored
+	if err := st.compact(r.statuses()); err != nil {
+		return err
+	}
+	r.store = st
+	log.Printf("rpc registry: restored %d servers from %s\n", len(r.servers), dir)
+	return nil
+}
+
+// Close closes the store of the registry, if any.
+func (r *GoRegistry) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.store == nil {
+		return nil
+	}
+	err := r.store.log.Close()
+	r.store = nil
+	return err
+}
+
+// statuses returns all the servers, alive or not. Callers must hold r.mu.
+func (r *GoRegistry) statuses() []InstanceStatus {
+	list := make([]InstanceStatus, 0, len(r.servers))
+	for _, s := range r.servers {
+		list = append(list, InstanceStatus{Instance: s.Instance, LastHeartbeat: s.start})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Addr < list[j].Addr
+	})
+	return list
+}
+
+// persist appends the change of s to the store, if any, compacting the
+// log when it grows too long. Errors are logged: the servers are kept in
+// memory regardless. Callers must hold r.mu.
+func (r *GoRegistry) persist(op string, s *ServerItem) {
+	if r.store == nil {
+		return
+	}
+	err := r.store.append(logEntry{Op: op, InstanceStatus: InstanceStatus{Instance: s.Instance, LastHeartbeat: s.start}})
+	if err == nil && r.store.entries >= compactThreshold {
+		err = r.store.compact(r.statuses())
+	}
+	if err != nil {
+		log.Println("rpc registry: store error:", err)
+	}
+}
+
+// load reads the servers of the snapshot and replays the log over them.
+// A truncated last entry, left by a crash while it was written, is
+// ignored.
+func (st *fileStore) load() ([]InstanceStatus, error) {
+	servers := make(map[string]InstanceStatus)
+	b, err := os.ReadFile(filepath.Join(st.dir, snapshotFile))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		var snapshot []InstanceStatus
+		if err := json.Unmarshal(b, &snapshot); err != nil {
+			return nil, errors.New("rpc registry: invalid snapshot: " + err.Error())
+		}
+		for _, status := range snapshot {
+			servers[status.Addr] = status
+		}
+	}
+	f, err := os.Open(filepath.Join(st.dir, logFile))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(nil, 1<<20)
+		for scanner.Scan() {
+			var e logEntry
+			if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+				log.Println("rpc registry: skip invalid log entry:", err)
+				continue
+			}
+			switch e.Op {
+			case "put":
+				servers[e.Addr] = e.InstanceStatus
+			case "remove":
+				delete(servers, e.Addr)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	statuses := make([]InstanceStatus, 0, len(servers))
+	for _, status := range servers {
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+func (st *fileStore) append(e logEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err := st.log.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	st.entries++
+	return nil
+}
+
+// compact writes the snapshot of statuses and empties the log. The
+// snapshot is renamed into place, so that a crash leaves either the old
+// snapshot and its log or the new one; replaying the old log over the new
+// snapshot yields the same servers.
+func (st *fileStore) compact(statuses []InstanceStatus) error {
+	b, err := json.Marshal(statuses)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(st.dir, snapshotFile+".tmp")
+	if err := writeFileSync(tmp, b); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(st.dir, snapshotFile)); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(st.dir, logFile), os.O_WRONLY|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	if st.log != nil {
+		_ = st.log.Close()
+	}
+	st.log = f
+	st.entries = 0
+	return nil
+}
+
+func writeFileSync(name string, b []byte) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,98 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// IndexHeader carries the index of the servers in lookup responses.
+	IndexHeader = "X-GoRPC-Index"
+	defaultWait = 30 * time.Second
+	maxWait = 10 * time.Minute
+)
+
+// bump records a change of the servers, waking up the blocked lookups.
+// Callers must hold r.mu.
+func (r *GoRegistry) bump() {
+	r.index++
+	close(r.changed)
+	r.changed = make(chan struct{})
+}
+
+// nextExpiry returns when the first server expires, zero if none does.
+// Callers must hold r.mu.
+func (r *GoRegistry) nextExpiry() time.Time {
+	var next time.Time
+	if r.timeout == 0 {
+		return next
+	}
+	for _, s := range r.servers {
+		if t := s.start.Add(r.timeout); next.IsZero() || t.Before(next) {
+			next = t
+		}
+	}
+	return next
+}
+
+// waitIndex blocks until the index of the servers differs from index, wait
+// elapses or ctx is done. Servers expiring in the meantime count as changes.
+func (r *GoRegistry) waitIndex(ctx context.Context, index uint64, wait time.Duration) {
+	deadline := time.NewTimer(wait)
+	defer deadline.Stop()
+	for {
+		r.mu.Lock()
+		r.sweep()
+		if r.index != index {
+			r.mu.Unlock()
+			return
+		}
+		changed := r.changed
+		next := r.nextExpiry()
+		r.mu.Unlock()
+
+		var expiry <-chan time.Time
+		var timer *time.Timer
+		if !next.IsZero() {
+			timer = time.NewTimer(time.Until(next))
+			expiry = timer.C
+		}
+		select {
+		case <-changed:
+		case <-expiry:
+		case <-deadline.C:
+			return
+		case <-ctx.Done():
+			return
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// block implements blocking lookups: when req has an index parameter, it
+// waits until the servers change from that index, for at most the wait
+// parameter, 30s by default. It returns an error without waiting if the
+// parameters are invalid.
+func (r *GoRegistry) block(req *http.Request) error {
+	query := req.URL.Query()
+	if !query.Has("index") {
+		return nil
+	}
+	index, err := strconv.ParseUint(query.Get("index"), 10, 64)
+	if err != nil {
+		return errors.New("invalid index: " + err.Error())
+	}
+	wait := defaultWait
+	if query.Has("wait") {
+		if wait, err = time.ParseDuration(query.Get("wait")); err != nil || wait < 0 {
+			return errors.New("invalid wait: " + query.Get("wait"))
+		}
+	}
+	r.waitIndex(req.Context(), index, min(wait, maxWait))
+	return nil
+}
@@ -0,0 +1,301 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuthorizationKey is the request metadata key holding the credentials
+// checked by BearerTokenAuth and HMACAuth: "Bearer <token>" or
+// "HMAC <key id>:<unix seconds>:<nonce>:<signature>".
+const AuthorizationKey = "authorization"
+
+// AuthInfo is what an Authenticator knows about a request.
+type AuthInfo struct {
+	ServiceMethod string      // as sent by the client, e.g. "Foo@1.2.0.Sum"
+	Args          interface{} // decoded arguments of the call
+	Metadata      map[string]string
+	Peer          *Peer
+}
+
+// Authenticator validates the credentials of a request and returns the
+// identity of the caller.
+type Authenticator func(info *AuthInfo) (identity string, err error)
+
+var errNoCredentials = errors.New("no credentials")
+
+// BearerTokenAuth accepts requests carrying one of the tokens, mapped to
+// the identity of their holder.
+func BearerTokenAuth(tokens map[string]string) Authenticator {
+	return func(info *AuthInfo) (string, error) {
+		token, ok := strings.CutPrefix(info.Metadata[AuthorizationKey], "Bearer ")
+		if !ok {
+			return "", errNoCredentials
+		}
+		for t, identity := range tokens {
+			if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+				return identity, nil
+			}
+		}
+		return "", errors.New("invalid token")
+	}
+}
+
+// ArgsDigest returns the digest of the arguments of a call signed by
+// HMACSignature: the hex SHA-256 of their JSON encoding, normalized so that
+// the client's arguments and the ones the server decoded agree whatever the
+// codec. Object members holding null, false, 0, "", [] or {} are dropped,
+// as gob does not send zero values, empty arrays and objects are null and
+// members are sorted by name. Both ends must use the same JSON field names,
+// and fields that only one of them has must be zero.
+func ArgsDigest(args interface{}) (string, error) {
+	b, err := json.Marshal(args)
+	if err != nil {
+		return "", err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return "", err
+	}
+	if b, err = json.Marshal(normalizeArgs(v)); err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// normalizeArgs returns v, decoded from JSON, with its zero values as nil,
+// see ArgsDigest.
+func normalizeArgs(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, e := range v {
+			if e = normalizeArgs(e); e == nil {
+				delete(v, k)
+			} else {
+				v[k] = e
+			}
+		}
+		if len(v) == 0 {
+			return nil
+		}
+	case []interface{}:
+		if len(v) == 0 {
+			return nil
+		}
+		for i, e := range v {
+			v[i] = normalizeArgs(e)
+		}
+	case json.Number:
+		if f, err := v.Float64(); err == nil && f == 0 {
+			return nil
+		}
+	case string:
+		if v == "" {
+			return nil
+		}
+	case bool:
+		if !v {
+			return nil
+		}
+	}
+	return v
+}
+
+// HMACSignature signs with the secret of keyID a call to serviceMethod
+// with the arguments of digest argsDigest, see ArgsDigest, made at the
+// unix time ts. nonce must be unique to the call.
+func HMACSignature(secret []byte, keyID string, ts int64, nonce, serviceMethod, argsDigest string) string {
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%s\n%d\n%s\n%s\n%s", keyID, ts, nonce, serviceMethod, argsDigest)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// HMACAuth accepts requests signed by HMACSignature with one of the
+// secrets, keyed by key id, within maxSkew of the server clock. The key id
+// is the identity of the caller. As the signature covers the method and
+// its arguments, and each nonce is accepted once, a signed call can
+// neither be altered nor replayed.
+func HMACAuth(secrets map[string][]byte, maxSkew time.Duration) Authenticator {
+	seen := newNonceCache()
+	return func(info *AuthInfo) (string, error) {
+		cred, ok := strings.CutPrefix(info.Metadata[AuthorizationKey], "HMAC ")
+		if !ok {
+			return "", errNoCredentials
+		}
+		parts := strings.Split(cred, ":")
+		if len(parts) != 4 || parts[2] == "" {
+			return "", errors.New("malformed signature")
+		}
+		keyID, nonce, sig := parts[0], parts[2], parts[3]
+		ts, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			return "", errors.New("malformed signature")
+		}
+		if skew := time.Since(time.Unix(ts, 0)); skew > maxSkew || skew < -maxSkew {
+			return "", errors.New("signature expired")
+		}
+		digest, err := ArgsDigest(info.Args)
+		if err != nil {
+			return "", err
+		}
+		secret, ok := secrets[keyID]
+		want := HMACSignature(secret, keyID, ts, nonce, info.ServiceMethod, digest)
+		if !ok || !hmac.Equal([]byte(sig), []byte(want)) {
+			return "", errors.New("invalid signature")
+		}
+		if !seen.add(keyID+":"+nonce, time.Unix(ts, 0).Add(maxSkew)) {
+			return "", errors.New("replayed signature")
+		}
+		return keyID, nil
+	}
+}
+
+// nonceCache remembers the nonces of the signatures accepted until they
+// expire.
+type nonceCache struct {
+	mu sync.Mutex
+	nonces map[string]time.Time
+	next int // size at which expired nonces are removed
+}
+
+func newNonceCache() *nonceCache {
+	return &nonceCache{nonces: make(map[string]time.Time), next: 1024}
+}
+
+// add records nonce until expiry, reporting false if it is already known.
+func (c *nonceCache) add(nonce string, expiry time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.nonces[nonce]; ok {
+		return false
+	}
+	if len(c.nonces) >= c.next {
+		now := time.Now()
+		for n, t := range c.nonces {
+			if t.Before(now) {
+				delete(c.nonces, n)
+			}
+		}
+		c.next = max(1024, 2*len(c.nonces))
+	}
+	c.nonces[nonce] = expiry
+	return true
+}
+
+// TLSAuth accepts requests over mutual TLS connections; the identity is
+// the common name of the client certificate.
+func TLSAuth() Authenticator {
+	return func(info *AuthInfo) (string, error) {
+		if info.Peer == nil || info.Peer.Identity() == "" {
+			return "", errNoCredentials
+		}
+		return info.Peer.Identity(), nil
+	}
+}
+
+// AnyAuth accepts requests accepted by one of auths, tried in order.
+func AnyAuth(auths ...Authenticator) Authenticator {
+	return func(info *AuthInfo) (string, error) {
+		err := errNoCredentials
+		for _, auth := range auths {
+			identity, e := auth(info)
+			if e == nil {
+				return identity, nil
+			}
+			if e != errNoCredentials {
+				err = e
+			}
+		}
+		return "", err
+	}
+}
+
+// ACL maps identities to the Service.Method patterns they may call, such
+// as "Foo.Sum", "Foo.*", "*.Sum" or "*". The service and the method are
+// matched separately, so "Foo.*" does not cover the service "Foo.v2". The
+// patterns of the identity "*" apply to every caller.
+type ACL map[string][]string
+
+// Allowed reports whether identity may call serviceMethod.
+func (a ACL) Allowed(identity, serviceMethod string) bool {
+	for _, id := range []string{identity, "*"} {
+		for _, pattern := range a[id] {
+			if matchServiceMethod(pattern, serviceMethod) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchServiceMethod matches serviceMethod against pattern, splitting both
+// at their last dot.
+func matchServiceMethod(pattern, serviceMethod string) bool {
+	if pattern == "*" {
+		return true
+	}
+	pdot, dot := strings.LastIndex(pattern, "."), strings.LastIndex(serviceMethod, ".")
+	if pdot < 0 || dot < 0 {
+		return false
+	}
+	okService, _ := path.Match(pattern[:pdot], serviceMethod[:dot])
+	okMethod, _ := path.Match(pattern[pdot+1:], serviceMethod[dot+1:])
+	return okService && okMethod
+}
+
+// SetAuth makes the server authenticate every request with auth, and
+// authorize it with acl unless acl is nil, before the method is called.
+// Requests failing are rejected with UNAUTHENTICATED or PERMISSION_DENIED.
+// Methods taking a context get the identity of the caller through
+// IdentityFromContext. It must be called before the server is used.
+func (s *Server) SetAuth(auth Authenticator, acl ACL) {
+	s.auth = auth
+	s.acl = acl
+}
+
+// authorize authenticates and authorizes req, recording the identity of
+// the caller.
+func (s *Server) authorize(req *request) error {
+	if s.auth == nil {
+		return nil
+	}
+	serviceMethod := req.svc.name + "." + req.mtype.method.Name
+	identity, err := s.auth(&AuthInfo{
+		ServiceMethod: req.h.ServiceMethod,
+		Args:          req.argv.Interface(),
+		Metadata:      req.metadata,
+		Peer:          req.peer,
+	})
+	if err != nil {
+		return &Error{Code: CodeUnauthenticated, Msg: "rpc server: unauthenticated: " + err.Error()}
+	}
+	if s.acl != nil && !s.acl.Allowed(identity, serviceMethod) {
+		return &Error{Code: CodePermissionDenied, Msg: fmt.Sprintf("rpc server: %s may not call %s", identity, serviceMethod)}
+	}
+	req.identity = identity
+	return nil
+}
+
+type identityCtx struct{}
+
+// IdentityFromContext returns the identity of the caller authenticated by
+// the Authenticator of the server, "" if there is none.
+func IdentityFromContext(ctx context.Context) string {
+	identity, _ := ctx.Value(identityCtx{}).(string)
+	return identity
+}
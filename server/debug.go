@@ -9,16 +9,26 @@ import (
 const debugText = `<html>
 	<body>
 	<title>GeeRPC Services</title>
-	{{range .}}
+	{{with .Limit}}
+	Active {{.Active}}, Queued {{.Queued}}
+	{{end}}
+	{{range .Services}}
 	<hr>
 	Service {{.Name}}
 	<hr>
 		<table>
-		<th align=center>Method</th><th align=center>Calls</th>
+		<th align=center>Method</th><th align=center>Calls</th><th align=center>Active</th><th align=center>Queued</th>
 		{{range $name, $mtype := .Method}}
 			<tr>
 			<td align=left font=fixed>{{$name}}({{$mtype.ArgType}}, {{$mtype.ReplyType}}) error</td>
 			<td align=center>{{$mtype.NumCalls}}</td>
+			{{with $mtype.Limit}}
+			<td align=center>{{.Active}}</td>
+			<td align=center>{{.Queued}}</td>
+			{{else}}
+			<td align=center>-</td>
+			<td align=center>-</td>
+			{{end}}
 			</tr>
 		{{end}}
 		</table>
@@ -32,23 +42,39 @@ type DebugHTTP struct {
 	*Server
 }
 
+type debugMethod struct {
+	*methodType
+	Limit *limiter
+}
+
 type debugService struct {
 	Name string
-	Method map[string]*methodType
+	Method map[string]debugMethod
 }
 
 func (server DebugHTTP) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	var services []debugService
 	server.serviceMap.Range(func(namei, svci interface{}) bool {
 		svc := svci.(*Service)
+		methods := make(map[string]debugMethod, len(svc.method))
+		for name, mtype := range svc.method {
+			m := debugMethod{methodType: mtype}
+			if lim, ok := server.methodLimits.Load(svc.name + "." + name); ok {
+				m.Limit = lim.(*limiter)
+			}
+			methods[name] = m
+		}
 		services = append(services, debugService{
 			Name: namei.(string),
-			Method: svc.method,
+			Method: methods,
 		})
 		return true
 	})
-	err := debug.Execute(w, services)
+	err := debug.Execute(w, struct {
+		Limit    *limiter
+		Services []debugService
+	}{server.limit.Load(), services})
 	if err != nil {
 		_, _ = fmt.Fprintln(w, "rpc: error executing template:", err.Error())
 	}
-}
\ No newline at end of file
+}
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// HealthService is the name of the built-in health-check service.
+const HealthService = "Health"
+
+type ServingStatus string
+
+const (
+	Serving        ServingStatus = "SERVING"
+	NotServing     ServingStatus = "NOT_SERVING"
+	ServiceUnknown ServingStatus = "SERVICE_UNKNOWN"
+)
+
+type HealthCheckRequest struct {
+	Service string // empty for the server as a whole
+}
+
+type HealthCheckResponse struct {
+	Status ServingStatus
+}
+
+// HealthWatchRequest asks Health.Watch to wait until the status of Service
+// differs from LastStatus.
+type HealthWatchRequest struct {
+	Service    string
+	LastStatus ServingStatus
+}
+
+// maxWatchWait bounds how long Health.Watch holds a request; the client is
+// expected to watch again with the returned status.
+const maxWatchWait = 30 * time.Second
+
+// HealthServer keeps the serving status of the server and of each of its
+// services. It is registered on every Server as the Health service.
+type HealthServer struct {
+	mu       sync.Mutex
+	statuses map[string]ServingStatus
+	changed  chan struct{} // closed and replaced on every status change
+	shutdown bool
+}
+
+func newHealthServer() *HealthServer {
+	return &HealthServer{
+		statuses: map[string]ServingStatus{"": Serving},
+		changed:  make(chan struct{}),
+	}
+}
+
+// SetServingStatus sets the status of service, "" being the server as a
+// whole. It has no effect once Shutdown has been called.
+func (h *HealthServer) SetServingStatus(service string, status ServingStatus) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.shutdown {
+		return
+	}
+	h.setLocked(service, status)
+}
+
+func (h *HealthServer) setLocked(service string, status ServingStatus) {
+	if h.statuses[service] == status {
+		return
+	}
+	h.statuses[service] = status
+	close(h.changed)
+	h.changed = make(chan struct{})
+}
+
+// Shutdown sets every status to NOT_SERVING and ignores later updates.
+// Pending and later Watch calls return right away from then on.
+func (h *HealthServer) Shutdown() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.shutdown = true
+	for service := range h.statuses {
+		h.setLocked(service, NotServing)
+	}
+	// wake up the watchers whose status did not change
+	close(h.changed)
+	h.changed = make(chan struct{})
+}
+
+// Resume sets every status to SERVING and accepts updates again.
+func (h *HealthServer) Resume() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.shutdown = false
+	for service := range h.statuses {
+		h.setLocked(service, Serving)
+	}
+}
+
+func (h *HealthServer) remove(service string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.statuses[service]; !ok {
+		return
+	}
+	delete(h.statuses, service)
+	close(h.changed)
+	h.changed = make(chan struct{})
+}
+
+func (h *HealthServer) status(service string) (ServingStatus, <-chan struct{}, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	status, ok := h.statuses[service]
+	if !ok {
+		status = ServiceUnknown
+	}
+	return status, h.changed, h.shutdown
+}
+
+func (h *HealthServer) Check(req HealthCheckRequest, resp *HealthCheckResponse) error {
+	resp.Status, _, _ = h.status(req.Service)
+	return nil
+}
+
+// Watch returns as soon as the status of req.Service differs from
+// req.LastStatus, or with the unchanged status after a while, always
+// before the deadline of ctx set by Option.HandleTimeout. Once the server
+// is shutting down it no longer waits: it fails with ErrShutdown if the
+// status is still req.LastStatus, so that watches do not hold up draining.
+func (h *HealthServer) Watch(ctx context.Context, req HealthWatchRequest, resp *HealthCheckResponse) error {
+	wait := maxWatchWait
+	if deadline, ok := ctx.Deadline(); ok {
+		// leave time for the reply
+		wait = min(wait, time.Until(deadline)*9/10)
+	}
+	timeout := time.NewTimer(wait)
+	defer timeout.Stop()
+	for {
+		status, changed, shutdown := h.status(req.Service)
+		resp.Status = status
+		if status != req.LastStatus {
+			return nil
+		}
+		if shutdown {
+			return ErrShutdown
+		}
+		select {
+		case <-changed:
+		case <-timeout.C:
+			return nil
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// ConcurrencyLimit bounds the number of requests handled at the same time.
+// Requests over MaxConcurrency wait in a queue of up to MaxQueue requests,
+// and requests finding the queue full are rejected with
+// RESOURCE_EXHAUSTED.
+type ConcurrencyLimit struct {
+	MaxConcurrency int // 0 for no limit
+	MaxQueue       int
+}
+
+type limiter struct {
+	slots      chan struct{}
+	maxPending int64
+	pending    int64 // requests holding or waiting for a slot
+}
+
+func newLimiter(l ConcurrencyLimit) *limiter {
+	if l.MaxConcurrency <= 0 {
+		return nil
+	}
+	return &limiter{
+		slots:      make(chan struct{}, l.MaxConcurrency),
+		maxPending: int64(l.MaxConcurrency + max(0, l.MaxQueue)),
+	}
+}
+
+// admit reserves a slot or a place in the queue for a request. It reports
+// false if the queue is full.
+func (l *limiter) admit() bool {
+	if atomic.AddInt64(&l.pending, 1) > l.maxPending {
+		atomic.AddInt64(&l.pending, -1)
+		return false
+	}
+	return true
+}
+
+// acquire waits for the slot of an admitted request, or until expired
+// fires, reporting whether it got the slot.
+func (l *limiter) acquire(expired <-chan time.Time) bool {
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-expired:
+		return false
+	}
+}
+
+func (l *limiter) release() {
+	<-l.slots
+	l.cancel()
+}
+
+// cancel gives up the place of an admitted request that never acquired
+// its slot.
+func (l *limiter) cancel() {
+	atomic.AddInt64(&l.pending, -1)
+}
+
+func (l *limiter) Active() int {
+	return len(l.slots)
+}
+
+func (l *limiter) Queued() int {
+	return max(0, int(atomic.LoadInt64(&l.pending))-len(l.slots))
+}
+
+// SetConcurrencyLimit limits the requests handled at the same time by the
+// whole server. A zero MaxConcurrency removes the limit. Requests already
+// admitted keep the limit they were admitted with.
+func (s *Server) SetConcurrencyLimit(l ConcurrencyLimit) {
+	s.limit.Store(newLimiter(l))
+}
+
+// SetMethodConcurrencyLimit limits the requests to serviceMethod handled
+// at the same time, across every version of the service. A zero
+// MaxConcurrency removes the limit.
+func (s *Server) SetMethodConcurrencyLimit(serviceMethod string, l ConcurrencyLimit) {
+	if lim := newLimiter(l); lim != nil {
+		s.methodLimits.Store(serviceMethod, lim)
+	} else {
+		s.methodLimits.Delete(serviceMethod)
+	}
+}
+
+// admit reserves room for req in the limiters that apply to it, the
+// method limiter first.
+func (s *Server) admit(req *request) error {
+	serviceMethod := req.svc.name + "." + req.mtype.method.Name
+	if v, ok := s.methodLimits.Load(serviceMethod); ok {
+		lim := v.(*limiter)
+		if !lim.admit() {
+			return &Error{Code: CodeResourceExhausted, Msg: "rpc server: too many requests to " + serviceMethod}
+		}
+		req.limiters = append(req.limiters, lim)
+	}
+	if lim := s.limit.Load(); lim != nil {
+		if !lim.admit() {
+			for _, l := range req.limiters {
+				l.cancel()
+			}
+			req.limiters = nil
+			return &Error{Code: CodeResourceExhausted, Msg: "rpc server: too many requests"}
+		}
+		req.limiters = append(req.limiters, lim)
+	}
+	return nil
+}
+
+// acquire waits for the slots of an admitted request, always in the same
+// order so that requests never wait on each other. If expired fires first,
+// it gives up the slots and places of req and reports false; a nil expired
+// waits for as long as needed.
+func (s *Server) acquire(req *request, expired <-chan time.Time) bool {
+	for i, lim := range req.limiters {
+		if !lim.acquire(expired) {
+			for _, l := range req.limiters[:i] {
+				l.release()
+			}
+			for _, l := range req.limiters[i:] {
+				l.cancel()
+			}
+			req.limiters = nil
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Server) release(req *request) {
+	for _, lim := range req.limiters {
+		lim.release()
+	}
+	req.limiters = nil
+}
@@ -0,0 +1,46 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+)
+
+// Peer describes the client at the other end of a connection.
+type Peer struct {
+	Addr net.Addr
+	// TLS is the state of the connection once the handshake completed, nil
+	// for plaintext connections.
+	TLS *tls.ConnectionState
+}
+
+// Identity returns the subject common name of the client certificate
+// verified during a mutual TLS handshake, or "" if the client presented
+// none.
+func (p *Peer) Identity() string {
+	if p.TLS == nil || len(p.TLS.VerifiedChains) == 0 || len(p.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return p.TLS.VerifiedChains[0][0].Subject.CommonName
+}
+
+// host returns the remote host of the peer, without the port.
+func (p *Peer) host() string {
+	if p.Addr == nil {
+		return ""
+	}
+	addr := p.Addr.String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+type peerCtx struct{}
+
+// PeerFromContext returns the peer of the request handled with ctx, as
+// passed to methods taking a context.
+func PeerFromContext(ctx context.Context) (*Peer, bool) {
+	p, ok := ctx.Value(peerCtx{}).(*Peer)
+	return p, ok
+}
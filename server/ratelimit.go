@@ -0,0 +1,81 @@
+package server
+
+import (
+	"fmt"
+
+	"gorpc/ratelimit"
+)
+
+// RateLimitByPeer as the Key of a RateLimit gives every remote host a
+// bucket of its own.
+const RateLimitByPeer = ":peer"
+
+// RateLimit is a token bucket limit of Rate requests per second with bursts
+// of up to Burst requests. Key selects what a bucket is kept for: empty for
+// a single bucket shared by every caller, RateLimitByPeer for one per
+// remote host, or a request metadata key such as "tenant" for one per
+// value of the key.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+	Key   string
+}
+
+type rateLimiter struct {
+	key     string
+	buckets *ratelimit.Buckets
+}
+
+// SetRateLimit limits the rate of requests to serviceMethod, or of every
+// request to the server if serviceMethod is empty. Requests over the limit
+// are rejected with RATE_LIMITED and a hint of when to retry. A zero Rate
+// removes the limit.
+func (s *Server) SetRateLimit(serviceMethod string, l RateLimit) {
+	if l.Rate <= 0 {
+		s.rateLimits.Delete(serviceMethod)
+		return
+	}
+	s.rateLimits.Store(serviceMethod, &rateLimiter{
+		key:     l.Key,
+		buckets: ratelimit.NewBuckets(l.Rate, l.Burst),
+	})
+}
+
+// bucket returns the bucket req draws from.
+func (l *rateLimiter) bucket(req *request) *ratelimit.Bucket {
+	var key string
+	switch l.key {
+	case "":
+	case RateLimitByPeer:
+		key = req.peer.host()
+	default:
+		key = req.metadata[l.key]
+	}
+	return l.buckets.Get(key)
+}
+
+// checkRate takes a token for req from the method limit and then the
+// server limit. If the server limit rejects req, the method token is given
+// back so that it is only spent on requests actually served.
+func (s *Server) checkRate(req *request) error {
+	var taken []*ratelimit.Bucket
+	for _, name := range []string{req.svc.name + "." + req.mtype.method.Name, ""} {
+		v, ok := s.rateLimits.Load(name)
+		if !ok {
+			continue
+		}
+		b := v.(*rateLimiter).bucket(req)
+		if ok, retryAfter := b.Allow(); !ok {
+			for _, b := range taken {
+				b.GiveBack()
+			}
+			return &Error{
+				Code:       CodeRateLimited,
+				Msg:        fmt.Sprintf("rpc server: rate limit exceeded, retry after %s", retryAfter),
+				RetryAfter: retryAfter,
+			}
+		}
+		taken = append(taken, b)
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+)
+
+// ReflectionService is the name of the built-in reflection service, which
+// lets generic tools discover the services of a server and their types.
+const ReflectionService = "Reflection"
+
+// TypeInfo describes a Go type as seen on the wire.
+type TypeInfo struct {
+	Name   string      // the Go type, e.g. "main.Args" or "[]int"
+	Kind   string      // the reflect.Kind, e.g. "struct" or "slice"
+	Elem   *TypeInfo   `json:",omitempty"` // element of pointers, slices, arrays and maps
+	Key    *TypeInfo   `json:",omitempty"` // key of maps
+	Len    int         `json:",omitempty"` // length of arrays
+	Fields []FieldInfo `json:",omitempty"` // exported fields of structs
+}
+
+type FieldInfo struct {
+	Name string
+	Tag  string `json:",omitempty"`
+	Type *TypeInfo
+}
+
+type MethodInfo struct {
+	Name      string
+	ArgType   *TypeInfo
+	ReplyType *TypeInfo
+	NumCalls  uint64
+}
+
+type ServiceInfo struct {
+	Name    string
+	Version string `json:",omitempty"`
+	Methods []MethodInfo
+}
+
+// ReflectionRequest selects the service to describe, by the name it is
+// registered under ("name@version" for versioned services) or by its name
+// and a version constraint, resolved as for calls; it is ignored when
+// listing services.
+type ReflectionRequest struct {
+	Service string
+	Version string `json:",omitempty"`
+}
+
+type ListServicesResponse struct {
+	Services []string
+}
+
+// DescribeType returns the structure of t. Struct types that refer to
+// themselves are described once; nested occurrences only carry the name
+// and kind.
+func DescribeType(t reflect.Type) *TypeInfo {
+	return describeType(t, make(map[reflect.Type]bool))
+}
+
+func describeType(t reflect.Type, seen map[reflect.Type]bool) *TypeInfo {
+	info := &TypeInfo{Name: t.String(), Kind: t.Kind().String()}
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Slice:
+		info.Elem = describeType(t.Elem(), seen)
+	case reflect.Array:
+		info.Len = t.Len()
+		info.Elem = describeType(t.Elem(), seen)
+	case reflect.Map:
+		info.Key = describeType(t.Key(), seen)
+		info.Elem = describeType(t.Elem(), seen)
+	case reflect.Struct:
+		if seen[t] {
+			return info
+		}
+		seen[t] = true
+		defer delete(seen, t)
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if !f.IsExported() {
+				continue
+			}
+			info.Fields = append(info.Fields, FieldInfo{
+				Name: f.Name,
+				Tag:  string(f.Tag),
+				Type: describeType(f.Type, seen),
+			})
+		}
+	}
+	return info
+}
+
+type reflectionService struct {
+	s *Server
+}
+
+func (r *reflectionService) ListServices(req ReflectionRequest, resp *ListServicesResponse) error {
+	r.s.serviceMap.Range(func(namei, _ interface{}) bool {
+		resp.Services = append(resp.Services, namei.(string))
+		return true
+	})
+	sort.Strings(resp.Services)
+	return nil
+}
+
+func (r *reflectionService) DescribeService(req ReflectionRequest, resp *ServiceInfo) error {
+	svc := r.s.lookupService(req.Service, req.Version)
+	if svc == nil {
+		name := req.Service
+		if req.Version != "" {
+			name += " matching version " + req.Version
+		}
+		return errors.New("rpc: service " + name + " not found")
+	}
+	resp.Name = svc.name
+	resp.Version = svc.version
+	for name, mtype := range svc.method {
+		resp.Methods = append(resp.Methods, MethodInfo{
+			Name:      name,
+			ArgType:   DescribeType(mtype.ArgType),
+			ReplyType: DescribeType(mtype.ReplyType),
+			NumCalls:  mtype.NumCalls(),
+		})
+	}
+	sort.Slice(resp.Methods, func(i, j int) bool {
+		return resp.Methods[i].Name < resp.Methods[j].Name
+	})
+	return nil
+}
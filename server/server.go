@@ -1,6 +1,10 @@
 package server
 
 import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"sync/atomic"
 	"net"
 	"net/http"
 	"io"
@@ -12,6 +16,7 @@ import (
 	"errors"
 	"time"
 	"fmt"
+	"sort"
 	"strings"
 )
 
@@ -27,6 +32,7 @@ type Option struct {
 	CodecType       string
 	ConnectTimeout time.Duration
 	HandleTimeout time.Duration
+	TLSConfig *tls.Config `json:"-"` // client side TLS configuration, nil for plaintext
 }
 
 type request struct {
@@ -34,6 +40,10 @@ type request struct {
 	argv, replyv reflect.Value
 	mtype *methodType
 	svc *Service
+	limiters []*limiter // concurrency limiters the request was admitted by
+	peer *Peer
+	metadata map[string]string
+	identity string // caller identity set by the authenticator
 }
 
 var DefaultOption = &Option{
@@ -50,8 +60,24 @@ var TestOption = &Option{
 
 type Server struct {
 	serviceMap sync.Map
+	vmu sync.RWMutex
+	versions map[string][]*Service // versioned services by name, highest version first
+	health *HealthServer
+	limit atomic.Pointer[limiter]
+	methodLimits sync.Map // service method -> *limiter
+	rateLimits sync.Map // service method, empty for the whole server -> *rateLimiter
+	auth Authenticator
+	acl ACL
+	inflight int64
+	mu sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns map[io.Closer]struct{}
+	shuttingDown bool
+	onShutdown []func()
 }
 
+var ErrShutdown = errors.New("rpc server: server is shutting down")
+
 func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	if req.Method != "CONNECT" {
 		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
@@ -79,26 +105,129 @@ func HandleHTTP() {
 }
 
 func (s *Server) Register(rcvr interface{}) error {
-	ns := NewService(rcvr)
-	if _, dup := s.serviceMap.LoadOrStore(ns.name, ns); dup {
-		return errors.New("rpc: service already defined: " + ns.name)
+	ns, err := NewService(rcvr)
+	if err != nil {
+		return err
+	}
+	return s.register(ns)
+}
+
+// RegisterName is like Register but uses name for the service instead of
+// the type name of the receiver, so that several receivers of the same
+// type, or several versions like "Foo.v2", can be served.
+func (s *Server) RegisterName(name string, rcvr interface{}) error {
+	ns, err := newService(name, rcvr)
+	if err != nil {
+		return err
+	}
+	return s.register(ns)
+}
+
+// RegisterVersion registers rcvr as version of the service name, a
+// semantic version such as "1.2.0". Several versions of a service can be
+// registered side by side; requests pick one through the version
+// constraint of their header. The service is registered under
+// "name@version".
+func (s *Server) RegisterVersion(name, version string, rcvr interface{}) error {
+	if !ValidVersion(version) {
+		return fmt.Errorf("rpc server: invalid version %q of service %s", version, name)
+	}
+	ns, err := newService(name, rcvr)
+	if err != nil {
+		return err
+	}
+	ns.version = version
+	return s.register(ns)
+}
+
+func (s *Server) register(ns *Service) error {
+	key := ns.key()
+	if _, dup := s.serviceMap.LoadOrStore(key, ns); dup {
+		return errors.New("rpc: service already defined: " + key)
 	}
+	if ns.version != "" {
+		s.vmu.Lock()
+		versions := append(s.versions[ns.name], ns)
+		sort.Slice(versions, func(i, j int) bool {
+			return CompareVersions(versions[i].version, versions[j].version) > 0
+		})
+		s.versions[ns.name] = versions
+		s.vmu.Unlock()
+	}
+	s.health.SetServingStatus(key, Serving)
+	for name := range ns.method {
+		log.Printf("rpc server: register %s.%s\n", key, name)
+	}
+	return nil
+}
+
+// Unregister removes the service registered under name ("name@version" for
+// versioned services); later requests for it fail while requests already
+// being handled complete.
+func (s *Server) Unregister(name string) error {
+	svci, ok := s.serviceMap.LoadAndDelete(name)
+	if !ok {
+		return errors.New("rpc: service " + name + " not found")
+	}
+	if svc := svci.(*Service); svc.version != "" {
+		s.vmu.Lock()
+		versions := s.versions[svc.name]
+		for i, v := range versions {
+			if v == svc {
+				versions = append(versions[:i:i], versions[i+1:]...)
+				break
+			}
+		}
+		if len(versions) == 0 {
+			delete(s.versions, svc.name)
+		} else {
+			s.versions[svc.name] = versions
+		}
+		s.vmu.Unlock()
+	}
+	s.health.remove(name)
+	log.Printf("rpc server: unregister %s\n", name)
 	return nil
 }
 
-func (s *Server) findService(serviceMethod string) (service *Service, mtype *methodType, err error) {
+// ServiceNames returns the sorted names of the services registered on s,
+// "name@version" for versioned ones, built-in services included. Servers
+// publish them to registries so that clients only route calls to servers
+// offering the service.
+func (s *Server) ServiceNames() []string {
+	var names []string
+	s.serviceMap.Range(func(namei, _ interface{}) bool {
+		names = append(names, namei.(string))
+		return true
+	})
+	sort.Strings(names)
+	return names
+}
+
+// Health returns the health service of the server, used to report the
+// serving status of the server and of each service.
+func (s *Server) Health() *HealthServer {
+	return s.health
+}
+
+// findService looks up the method of the service. Without a version
+// constraint an unversioned service is preferred, falling back to the
+// highest version; with one, the highest version satisfying it is used.
+func (s *Server) findService(serviceMethod, version string) (service *Service, mtype *methodType, err error) {
 	dot := strings.LastIndex(serviceMethod, ".")
 	if dot < 0 {
 		err = errors.New("rpc: service/method request ill-formed: " + serviceMethod)
 		return
 	}
 	serviceName, methodName := serviceMethod[:dot], serviceMethod[dot+1:]
-	svc, ok := s.serviceMap.Load(serviceName)
-	if !ok {
+	service = s.lookupService(serviceName, version)
+	if service == nil {
+		if version != "" {
+			serviceName += " matching version " + version
+		}
 		err = errors.New("rpc: service " + serviceName + " not found")
 		return
 	}
-	service = svc.(*Service)
 	mtype = service.method[methodName]
 	if mtype == nil {
 		err = errors.New("rpc: method " + methodName + " not found")
@@ -106,21 +235,99 @@ func (s *Server) findService(serviceMethod string) (service *Service, mtype *met
 	return
 }
 
+// lookupService returns the service registered under name, either as is or
+// as "name@version". The constraint version selects among the versions of
+// name; it does not apply to services registered without versions, such as
+// the built-in ones.
+func (s *Server) lookupService(name, version string) *Service {
+	if version == "" || !s.hasVersions(name) {
+		if svc, ok := s.serviceMap.Load(name); ok {
+			return svc.(*Service)
+		}
+	}
+	return s.matchVersion(name, version)
+}
+
+func (s *Server) hasVersions(name string) bool {
+	s.vmu.RLock()
+	defer s.vmu.RUnlock()
+	return len(s.versions[name]) > 0
+}
+
+// matchVersion returns the highest version of the service satisfying the
+// constraint version. Without a constraint, releases are preferred over
+// pre-releases.
+func (s *Server) matchVersion(name, version string) *Service {
+	s.vmu.RLock()
+	defer s.vmu.RUnlock()
+	var pre *Service
+	for _, svc := range s.versions[name] {
+		switch {
+		case version != "":
+			if MatchVersion(svc.version, version) {
+				return svc
+			}
+		case !strings.Contains(svc.version, "-"):
+			return svc
+		case pre == nil:
+			pre = svc
+		}
+	}
+	return pre
+}
+
 func Register(rcvr interface{}) error {
 	return DefaultServer.Register(rcvr)
 }
 
+func RegisterName(name string, rcvr interface{}) error {
+	return DefaultServer.RegisterName(name, rcvr)
+}
+
+func RegisterVersion(name, version string, rcvr interface{}) error {
+	return DefaultServer.RegisterVersion(name, version, rcvr)
+}
+
 func NewServer() *Server {
-	return &Server{}
+	s := &Server{
+		versions: make(map[string][]*Service),
+		health: newHealthServer(),
+		listeners: make(map[net.Listener]struct{}),
+		conns: make(map[io.Closer]struct{}),
+	}
+	for name, rcvr := range map[string]interface{}{
+		HealthService: s.health,
+		ReflectionService: &reflectionService{s},
+	} {
+		ns, _ := newService(name, rcvr)
+		s.serviceMap.Store(name, ns)
+		s.health.SetServingStatus(name, Serving)
+	}
+	return s
 }
 
 var DefaultServer = NewServer()
 
 func (s *Server) Accept(lis net.Listener) {
+	s.mu.Lock()
+	if s.shuttingDown {
+		s.mu.Unlock()
+		_ = lis.Close()
+		return
+	}
+	s.listeners[lis] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, lis)
+		s.mu.Unlock()
+	}()
 	for {
 		conn, err := lis.Accept()
 		if err != nil {
-			log.Printf("rpc server: accept error: %v", err)
+			if !s.isShuttingDown() {
+				log.Printf("rpc server: accept error: %v", err)
+			}
 			return
 		}
 		go s.ServeConn(conn)
@@ -131,13 +338,63 @@ func Accept(lis net.Listener) {
 	DefaultServer.Accept(lis)
 }
 
+// AcceptTLS is like Accept but serves TLS connections configured by config.
+// With config.ClientAuth set to tls.RequireAndVerifyClientCert, methods
+// taking a context get the identity of the client certificate through
+// PeerFromContext.
+func (s *Server) AcceptTLS(lis net.Listener, config *tls.Config) {
+	s.Accept(tls.NewListener(lis, config))
+}
+
+func AcceptTLS(lis net.Listener, config *tls.Config) {
+	DefaultServer.AcceptTLS(lis, config)
+}
+
+const tlsHandshakeTimeout = 10 * time.Second
+
+// newPeer describes the client of conn, completing the TLS handshake of
+// TLS connections.
+func newPeer(conn io.ReadWriteCloser) (*Peer, error) {
+	peer := new(Peer)
+	if c, ok := conn.(net.Conn); ok {
+		peer.Addr = c.RemoteAddr()
+	}
+	if c, ok := conn.(*tls.Conn); ok {
+		ctx, cancel := context.WithTimeout(context.Background(), tlsHandshakeTimeout)
+		defer cancel()
+		if err := c.HandshakeContext(ctx); err != nil {
+			return nil, err
+		}
+		state := c.ConnectionState()
+		peer.TLS = &state
+	}
+	return peer, nil
+}
+
 func (s *Server) ServeConn(conn io.ReadWriteCloser) {
+	s.mu.Lock()
+	if s.shuttingDown {
+		s.mu.Unlock()
+		_ = conn.Close()
+		return
+	}
+	s.conns[conn] = struct{}{}
+	s.mu.Unlock()
 	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
 		_ = conn.Close()
 	}()
 
+	peer, err := newPeer(conn)
+	if err != nil {
+		log.Printf("rpc server: tls handshake error: %v", err)
+		return
+	}
 	var opt Option
-	if err := json.NewDecoder(conn).Decode(&opt); err != nil {
+	dec := json.NewDecoder(conn)
+	if err := dec.Decode(&opt); err != nil {
 		log.Printf("rpc server: options error: %v", err)
 		return
 	}
@@ -150,12 +407,27 @@ func (s *Server) ServeConn(conn io.ReadWriteCloser) {
 		log.Printf("rpc server: invalid codec type %s", opt.CodecType)
 		return
 	}
-	s.serveCodec(codec(conn), &opt)
+	// the json decoder may have buffered the beginning of the first request,
+	// preceded by the newline written by the client's json encoder
+	br := bufio.NewReader(io.MultiReader(dec.Buffered(), conn))
+	if b, err := br.Peek(1); err == nil && b[0] == '\n' {
+		_, _ = br.Discard(1)
+	}
+	s.serveCodec(codec(&bufferedConn{br, conn}), &opt, peer)
+}
+
+type bufferedConn struct {
+	io.Reader
+	io.ReadWriteCloser
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.Reader.Read(p)
 }
 
 var invalidRequest = struct{}{}
 
-func (s *Server) serveCodec(cc codec.MsgCodec, opt *Option) {
+func (s *Server) serveCodec(cc codec.MsgCodec, opt *Option, peer *Peer) {
 	sending := new(sync.Mutex)
 	wg := new(sync.WaitGroup)
 	for {
@@ -164,11 +436,28 @@ func (s *Server) serveCodec(cc codec.MsgCodec, opt *Option) {
 			if req == nil {
 				break
 			}
-			req.h.Error = err.Error()
-			s.sendResponse(cc, req.h, invalidRequest, sending)
+			s.sendError(cc, req.h, err, sending)
+			continue
+		}
+		req.peer = peer
+		if s.isShuttingDown() {
+			s.sendError(cc, req.h, ErrShutdown, sending)
+			continue
+		}
+		if err := s.authorize(req); err != nil {
+			s.sendError(cc, req.h, err, sending)
+			continue
+		}
+		if err := s.checkRate(req); err != nil {
+			s.sendError(cc, req.h, err, sending)
+			continue
+		}
+		if err := s.admit(req); err != nil {
+			s.sendError(cc, req.h, err, sending)
 			continue
 		}
 		wg.Add(1)
+		atomic.AddInt64(&s.inflight, 1)
 		go s.handleRequest(cc, req, sending, wg, opt.HandleTimeout)
 	}
 	wg.Wait()
@@ -191,9 +480,14 @@ func (s *Server) readRequest(cc codec.MsgCodec) (*request, error) {
 	if err != nil {
 		return nil, err
 	}
-	req := &request{h: h}
-	req.svc, req.mtype, err = s.findService(h.ServiceMethod)
+	// the metadata is kept on the request rather than sent back with the
+	// response
+	req := &request{h: h, metadata: h.Metadata}
+	h.Metadata = nil
+	req.svc, req.mtype, err = s.findService(h.ServiceMethod, h.Version)
 	if err != nil {
+		// skip the body so that the next header is read from the right place
+		_ = cc.ReadBody(nil)
 		return req, err
 	}
 	req.argv = req.mtype.newArgv()
@@ -210,6 +504,18 @@ func (s *Server) readRequest(cc codec.MsgCodec) (*request, error) {
 	return req, nil
 }
 
+// sendError sends err as the response to h, with its status code if it
+// is an *Error.
+func (s *Server) sendError(cc codec.MsgCodec, h *codec.Header, err error, sending *sync.Mutex) {
+	h.Error = err.Error()
+	var e *Error
+	if errors.As(err, &e) {
+		h.Code = e.Code
+		h.RetryAfter = e.RetryAfter
+	}
+	s.sendResponse(cc, h, invalidRequest, sending)
+}
+
 func (s *Server) sendResponse(cc codec.MsgCodec, h *codec.Header, body interface{}, sending *sync.Mutex) {
 	sending.Lock()
 	defer sending.Unlock()
@@ -220,10 +526,31 @@ func (s *Server) sendResponse(cc codec.MsgCodec, h *codec.Header, body interface
 
 func (s *Server) handleRequest(cc codec.MsgCodec, req *request, sending *sync.Mutex, wg *sync.WaitGroup, timeout time.Duration) {
 	defer wg.Done()
+	defer atomic.AddInt64(&s.inflight, -1)
+	// the handle timeout covers the time spent queued for a slot
+	var deadline time.Time
+	var expired <-chan time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	timedOut := func() {
+		req.h.Error = fmt.Sprintf("rpc server: request handle timeout: expect within %s", timeout)
+		s.sendResponse(cc, req.h, invalidRequest, sending)
+	}
+	if !s.acquire(req, expired) {
+		timedOut()
+		return
+	}
 	called := make(chan struct{})
 	sent := make(chan struct{})
 	go func() {
-		err := req.svc.call(req.mtype, req.argv, req.replyv)
+		ctx, cancel := s.requestContext(req, deadline)
+		err := req.svc.call(ctx, req.mtype, req.argv, req.replyv)
+		cancel()
+		s.release(req)
 		called <- struct{}{}
 		if err != nil {
 			req.h.Error = err.Error()
@@ -241,12 +568,77 @@ func (s *Server) handleRequest(cc codec.MsgCodec, req *request, sending *sync.Mu
 		return
 	} else {
 		select {
-		case <-time.After(timeout):
-			req.h.Error = fmt.Sprintf("rpc server: request handle timeout: expect within %s", timeout)
-			s.sendResponse(cc, req.h, invalidRequest, sending)
+		case <-expired:
+			timedOut()
 		case <-called:
 			<-sent
 		}
 		
 	}
-}
\ No newline at end of file
+}
+// requestContext returns the context passed to methods taking one, done
+// at the deadline of the handle timeout unless deadline is zero.
+func (s *Server) requestContext(req *request, deadline time.Time) (context.Context, context.CancelFunc) {
+	ctx := context.WithValue(context.Background(), peerCtx{}, req.peer)
+	ctx = context.WithValue(ctx, identityCtx{}, req.identity)
+	if !deadline.IsZero() {
+		return context.WithDeadline(ctx, deadline)
+	}
+	return context.WithCancel(ctx)
+}
+
+func (s *Server) isShuttingDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.shuttingDown
+}
+
+const shutdownPollInterval = 50 * time.Millisecond
+
+// RegisterOnShutdown registers f to be called by Shutdown once the health
+// status flipped to NOT_SERVING, before draining, such as to deregister the
+// server from a registry.
+func (s *Server) RegisterOnShutdown(f func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onShutdown = append(s.onShutdown, f)
+}
+
+// Shutdown gracefully stops the server: the health status flips to
+// NOT_SERVING, the functions registered with RegisterOnShutdown are called,
+// listeners are closed, new requests are rejected and in-flight requests
+// are drained before the connections are closed. If ctx expires first, the
+// connections are closed anyway and ctx.Err() returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.health.Shutdown()
+	s.mu.Lock()
+	onShutdown := s.onShutdown
+	s.mu.Unlock()
+	for _, f := range onShutdown {
+		f()
+	}
+	s.mu.Lock()
+	s.shuttingDown = true
+	for lis := range s.listeners {
+		_ = lis.Close()
+	}
+	s.mu.Unlock()
+
+	var err error
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for err == nil && atomic.LoadInt64(&s.inflight) > 0 {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-ticker.C:
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		_ = conn.Close()
+	}
+	return err
+}
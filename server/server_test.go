@@ -0,0 +1,618 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"gorpc/codec"
+)
+
+type Foo int
+
+type Args struct{ Num1, Num2 int }
+
+func (f Foo) Sleep(args Args, reply *int) error {
+	time.Sleep(time.Duration(args.Num1) * time.Millisecond)
+	*reply = args.Num1 + args.Num2
+	return nil
+}
+
+func _assert(t *testing.T, condition bool, msg string, v ...interface{}) {
+	t.Helper()
+	if !condition {
+		t.Errorf("assertion failed: "+msg, v...)
+	}
+}
+
+// 测试用的最小客户端，避免依赖client包
+type testConn struct {
+	cc      codec.MsgCodec
+	seq      uint64
+	version  string
+	metadata map[string]string
+}
+
+func dialTest(t *testing.T, addr string) *testConn {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	_ = json.NewEncoder(conn).Encode(DefaultOption)
+	return &testConn{cc: codec.NewGobCodec(conn)}
+}
+
+func (c *testConn) call(serviceMethod string, args, reply interface{}) error {
+	c.seq++
+	if err := c.cc.Write(&codec.Header{ServiceMethod: serviceMethod, Seq: c.seq, Version: c.version, Metadata: c.metadata}, args); err != nil {
+		return err
+	}
+	var h codec.Header
+	if err := c.cc.ReadHeader(&h); err != nil {
+		return err
+	}
+	if h.Error != "" {
+		_ = c.cc.ReadBody(nil)
+		return &Error{Code: h.Code, Msg: h.Error, RetryAfter: h.RetryAfter}
+	}
+	return c.cc.ReadBody(reply)
+}
+
+func startServer(t *testing.T) (*Server, string) {
+	t.Helper()
+	s := NewServer()
+	var foo Foo
+	if err := s.Register(&foo); err != nil {
+		t.Fatalf("register error: %v", err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("network error: %v", err)
+	}
+	go s.Accept(l)
+	return s, l.Addr().String()
+}
+
+func TestHealth(t *testing.T) {
+	s, addr := startServer(t)
+	c := dialTest(t, addr)
+
+	var resp HealthCheckResponse
+	err := c.call("Health.Check", HealthCheckRequest{}, &resp)
+	_assert(t, err == nil && resp.Status == Serving, "server status %s, err %v", resp.Status, err)
+	_ = c.call("Health.Check", HealthCheckRequest{Service: "Foo"}, &resp)
+	_assert(t, resp.Status == Serving, "Foo status %s", resp.Status)
+	_ = c.call("Health.Check", HealthCheckRequest{Service: "Bar"}, &resp)
+	_assert(t, resp.Status == ServiceUnknown, "Bar status %s", resp.Status)
+
+	// Watch在状态变化时返回
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		s.Health().SetServingStatus("Foo", NotServing)
+	}()
+	start := time.Now()
+	err = c.call("Health.Watch", HealthWatchRequest{Service: "Foo", LastStatus: Serving}, &resp)
+	_assert(t, err == nil && resp.Status == NotServing, "watch status %s, err %v", resp.Status, err)
+	_assert(t, time.Since(start) < time.Second, "watch did not return on change")
+
+	// 设置了HandleTimeout时，Watch在超时之前返回当前状态
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer conn.Close()
+	opt := *DefaultOption
+	opt.HandleTimeout = 100 * time.Millisecond
+	_ = json.NewEncoder(conn).Encode(&opt)
+	tc := &testConn{cc: codec.NewGobCodec(conn)}
+	for i := 0; i < 2; i++ {
+		start = time.Now()
+		err = tc.call("Health.Watch", HealthWatchRequest{LastStatus: Serving}, &resp)
+		elapsed := time.Since(start)
+		_assert(t, err == nil && resp.Status == Serving, "watch %d: status %s, err %v", i, resp.Status, err)
+		_assert(t, elapsed >= 50*time.Millisecond && elapsed < 100*time.Millisecond, "watch %d returned after %v", i, elapsed)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	s, addr := startServer(t)
+	slow := dialTest(t, addr)
+	watcher := dialTest(t, addr)
+
+	done := make(chan error, 1)
+	var reply int
+	go func() {
+		done <- slow.call("Foo.Sleep", Args{Num1: 200, Num2: 1}, &reply)
+	}()
+	watched := make(chan ServingStatus, 1)
+	go func() {
+		var resp HealthCheckResponse
+		_ = watcher.call("Health.Watch", HealthWatchRequest{LastStatus: Serving}, &resp)
+		watched <- resp.Status
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	err := s.Shutdown(context.Background())
+	_assert(t, err == nil, "shutdown error: %v", err)
+	_assert(t, <-watched == NotServing, "status did not flip to NOT_SERVING")
+	// 正在处理的请求在关闭前完成
+	err = <-done
+	_assert(t, err == nil && reply == 201, "in-flight request failed: %v", err)
+
+	// 关闭后不再接受新连接
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	if err == nil {
+		_ = conn.Close()
+	}
+	_assert(t, err != nil, "server still accepting connections")
+}
+
+func TestShutdownWatch(t *testing.T) {
+	s, addr := startServer(t)
+	c := dialTest(t, addr)
+	s.RegisterOnShutdown(func() { time.Sleep(200 * time.Millisecond) })
+
+	// 关闭回调执行期间发起的Watch不会阻塞排空
+	go func() {
+		// 与client.WatchHealth一样，每次返回后以最新状态继续Watch
+		last := Serving
+		for {
+			var resp HealthCheckResponse
+			if err := c.call("Health.Watch", HealthWatchRequest{LastStatus: last}, &resp); err != nil {
+				return
+			}
+			last = resp.Status
+		}
+	}()
+	time.Sleep(50 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	err := s.Shutdown(ctx)
+	_assert(t, err == nil && time.Since(start) < time.Second, "shutdown took %v, err %v", time.Since(start), err)
+}
+
+type Node struct {
+	Value int
+	Next  *Node
+	Tags  map[string][]string `json:"tags"`
+	note  string
+}
+
+func TestReflection(t *testing.T) {
+	s, addr := startServer(t)
+	c := dialTest(t, addr)
+
+	var list ListServicesResponse
+	err := c.call("Reflection.ListServices", ReflectionRequest{}, &list)
+	_assert(t, err == nil, "list error: %v", err)
+	_assert(t, len(list.Services) == 3 && list.Services[0] == "Foo", "unexpected services: %v", list.Services)
+
+	var svc ServiceInfo
+	err = c.call("Reflection.DescribeService", ReflectionRequest{Service: "Foo"}, &svc)
+	_assert(t, err == nil, "describe error: %v", err)
+	_assert(t, len(svc.Methods) == 1 && svc.Methods[0].Name == "Sleep", "unexpected methods: %+v", svc.Methods)
+	arg := svc.Methods[0].ArgType
+	_assert(t, arg.Kind == "struct" && len(arg.Fields) == 2 && arg.Fields[1].Name == "Num2", "unexpected arg type: %+v", arg)
+	reply := svc.Methods[0].ReplyType
+	_assert(t, reply.Kind == "ptr" && reply.Elem.Kind == "int", "unexpected reply type: %+v", reply)
+
+	err = c.call("Reflection.DescribeService", ReflectionRequest{Service: "Bar"}, &svc)
+	_assert(t, err != nil, "expected error for unknown service")
+
+	// 带版本的服务可按名称和版本约束描述，与调用时一样解析版本
+	var v1 Foo
+	var v2 FooV2
+	_ = s.RegisterVersion("Bar", "1.0.0", &v1)
+	_ = s.RegisterVersion("Bar", "2.0.0", &v2)
+	for _, tc := range []struct{ service, version, want string }{
+		{"Bar", "", "2.0.0"},
+		{"Bar", "^1", "1.0.0"},
+		{"Bar@1.0.0", "", "1.0.0"},
+	} {
+		svc = ServiceInfo{}
+		err = c.call("Reflection.DescribeService", ReflectionRequest{Service: tc.service, Version: tc.version}, &svc)
+		_assert(t, err == nil && svc.Version == tc.want, "describe %s %q: %s, %v", tc.service, tc.version, svc.Version, err)
+	}
+	err = c.call("Reflection.DescribeService", ReflectionRequest{Service: "Bar", Version: "^3"}, &svc)
+	_assert(t, err != nil, "expected error for unknown version")
+
+	// 自引用类型只展开一层，未导出字段被忽略
+	node := DescribeType(reflect.TypeOf(Node{}))
+	_assert(t, len(node.Fields) == 3, "unexpected fields: %+v", node.Fields)
+	next := node.Fields[1].Type
+	_assert(t, next.Kind == "ptr" && next.Elem.Name == "server.Node" && next.Elem.Fields == nil, "recursive type expanded: %+v", next.Elem)
+	tags := node.Fields[2]
+	_assert(t, tags.Tag == `json:"tags"` && tags.Type.Key.Kind == "string" && tags.Type.Elem.Kind == "slice", "unexpected map field: %+v", tags)
+}
+
+func TestRegisterName(t *testing.T) {
+	s, addr := startServer(t)
+	c := dialTest(t, addr)
+
+	// 同一类型的两个实例以不同名称注册
+	var foo2 Foo
+	err := s.RegisterName("Foo.v2", &foo2)
+	_assert(t, err == nil, "register Foo.v2 error: %v", err)
+	err = s.RegisterName("Foo.v2", &foo2)
+	_assert(t, err != nil, "expected duplicate service error")
+	var reply int
+	err = c.call("Foo.v2.Sleep", Args{Num1: 1, Num2: 2}, &reply)
+	_assert(t, err == nil && reply == 3, "call Foo.v2: %d, %v", reply, err)
+
+	// 注销后请求失败
+	err = s.Unregister("Foo.v2")
+	_assert(t, err == nil, "unregister error: %v", err)
+	err = c.call("Foo.v2.Sleep", Args{Num1: 1, Num2: 2}, &reply)
+	_assert(t, err != nil, "call succeeded after unregister")
+	err = s.Unregister("Foo.v2")
+	_assert(t, err != nil, "expected error unregistering twice")
+
+	// 非法名称返回错误而不是退出进程
+	err = s.RegisterName("foo", &foo2)
+	_assert(t, err != nil, "expected invalid name error")
+	err = s.Register(&struct{ Foo }{})
+	_assert(t, err != nil, "expected invalid name error for anonymous type")
+	type Empty int
+	var empty Empty
+	err = s.Register(&empty)
+	_assert(t, err != nil, "expected error for type without methods")
+}
+
+func TestMatchVersion(t *testing.T) {
+	cases := []struct {
+		ver, constraint string
+		want            bool
+	}{
+		{"1.2.3", "", true},
+		{"1.2.3", "*", true},
+		{"1.2.3", "1.2.3", true},
+		{"1.2.4", "=1.2.3", false},
+		{"1.2.9", "1.2", true},
+		{"1.3.0", "1.2.x", false},
+		{"1.9.0", "^1.2.3", true},
+		{"2.0.0", "^1.2.3", false},
+		{"0.2.9", "^0.2.3", true},
+		{"0.3.0", "^0.2.3", false},
+		{"1.2.9", "~1.2.3", true},
+		{"1.3.0", "~1.2.3", false},
+		{"1.5.0", ">=1.2 <2", true},
+		{"2.0.0", ">=1.2 <2", false},
+		{"3.1.0", "^1 || ^3", true},
+		{"2.0.0-rc.1", "<2.0.0", false},
+		{"2.0.0-rc.1", "^1.2", false},
+		{"2.0.0-rc.1", "<2", false},
+		{"1.3.0-beta", "~1.2", false},
+		{"2.0.0-rc.1", "*", false},
+		{"2.0.0-rc.2", ">=2.0.0-rc.1 <2.1", true},
+		{"2.0.1-rc.1", ">=2.0.0-rc.1", false},
+		{"2.0.0-rc.1", "2.0.0-rc.1", true},
+		{"1.0.0-rc.10", ">1.0.0-rc.2", true},
+		{"1.0.0-rc.2", ">1.0.0-rc.10", false},
+		{"1.2.3+build.5", "1.2.3", true},
+		{"1.2.4", ">1.2.3+build.5", true},
+		{"1.2.3+", "1.2.3", false},
+		{"1.2", "1.2", false},
+		{"1.2.3", "!1", false},
+	}
+	for _, c := range cases {
+		got := MatchVersion(c.ver, c.constraint)
+		_assert(t, got == c.want, "MatchVersion(%q, %q) = %v", c.ver, c.constraint, got)
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	// 预发布版本按语义化版本规范逐段比较，数字段按数值比较
+	ordered := []string{"1.0.0-alpha", "1.0.0-alpha.1", "1.0.0-alpha.beta", "1.0.0-beta.2",
+		"1.0.0-beta.11", "1.0.0-rc.1", "1.0.0-rc.2", "1.0.0-rc.10", "1.0.0"}
+	for i := 1; i < len(ordered); i++ {
+		a, b := ordered[i-1], ordered[i]
+		_assert(t, CompareVersions(a, b) < 0 && CompareVersions(b, a) > 0, "%s should be lower than %s", a, b)
+	}
+	// 构建元数据不影响比较
+	_assert(t, CompareVersions("1.0.0+build.1", "1.0.0+build.2") == 0, "build metadata compared")
+	_assert(t, ValidVersion("1.0.0-rc.1+build.5"), "build metadata rejected")
+}
+
+type FooV2 int
+
+func (f FooV2) Sleep(args Args, reply *int) error {
+	*reply = (args.Num1 + args.Num2) * 2
+	return nil
+}
+
+func TestRegisterVersion(t *testing.T) {
+	s, addr := startServer(t)
+	var v1 Foo
+	var v2 FooV2
+	err := s.RegisterVersion("Foo", "1.1.0", &v1)
+	_assert(t, err == nil, "register Foo@1.1.0 error: %v", err)
+	err = s.RegisterVersion("Foo", "2.0.0", &v2)
+	_assert(t, err == nil, "register Foo@2.0.0 error: %v", err)
+	err = s.RegisterVersion("Foo", "2.0", &v2)
+	_assert(t, err != nil, "expected invalid version error")
+
+	call := func(version string) (int, error) {
+		c := dialTest(t, addr)
+		c.version = version
+		var reply int
+		err := c.call("Foo.Sleep", Args{Num1: 1, Num2: 2}, &reply)
+		return reply, err
+	}
+	// 未指定版本时使用未带版本注册的服务
+	reply, err := call("")
+	_assert(t, err == nil && reply == 3, "call without version: %d, %v", reply, err)
+	// 按语义化版本范围选择，多个版本匹配时选择最高的
+	reply, err = call("^2")
+	_assert(t, err == nil && reply == 6, "call ^2: %d, %v", reply, err)
+	reply, err = call("~1.1")
+	_assert(t, err == nil && reply == 3, "call ~1.1: %d, %v", reply, err)
+	reply, err = call(">=1")
+	_assert(t, err == nil && reply == 6, "call >=1: %d, %v", reply, err)
+	_, err = call("^3")
+	_assert(t, err != nil, "expected no matching version for ^3")
+
+	err = s.Unregister("Foo@2.0.0")
+	_assert(t, err == nil, "unregister Foo@2.0.0 error: %v", err)
+	reply, err = call(">=1")
+	_assert(t, err == nil && reply == 3, "call >=1 after unregister: %d, %v", reply, err)
+
+	// 预发布版本只在约束明确指定时使用
+	_ = s.RegisterVersion("Bar", "1.0.0", &v1)
+	_ = s.RegisterVersion("Bar", "2.0.0-rc.1", &v2)
+	callBar := func(version string) (int, error) {
+		c := dialTest(t, addr)
+		c.version = version
+		var reply int
+		err := c.call("Bar.Sleep", Args{Num1: 1, Num2: 2}, &reply)
+		return reply, err
+	}
+	for _, version := range []string{"", "^1", ">=1"} {
+		reply, err = callBar(version)
+		_assert(t, err == nil && reply == 3, "call Bar %q: %d, %v", version, reply, err)
+	}
+	reply, err = callBar("2.0.0-rc.1")
+	_assert(t, err == nil && reply == 6, "call Bar 2.0.0-rc.1: %d, %v", reply, err)
+
+	// 版本约束不作用于未带版本注册的服务，如内置服务
+	c := dialTest(t, addr)
+	c.version = "^1"
+	var resp HealthCheckResponse
+	err = c.call("Health.Check", HealthCheckRequest{}, &resp)
+	_assert(t, err == nil && resp.Status == Serving, "versioned Health.Check: %s, %v", resp.Status, err)
+	var list ListServicesResponse
+	err = c.call("Reflection.ListServices", ReflectionRequest{}, &list)
+	_assert(t, err == nil && len(list.Services) > 0, "versioned Reflection.ListServices: %v", err)
+}
+
+func TestConcurrencyLimit(t *testing.T) {
+	s, addr := startServer(t)
+	s.SetMethodConcurrencyLimit("Foo.Sleep", ConcurrencyLimit{MaxConcurrency: 1, MaxQueue: 1})
+
+	// 一个请求处理中、一个排队，第三个被拒绝
+	errs := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		c := dialTest(t, addr)
+		go func() {
+			var reply int
+			errs <- c.call("Foo.Sleep", Args{Num1: 200}, &reply)
+		}()
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	rec := httptest.NewRecorder()
+	DebugHTTP{s}.ServeHTTP(rec, httptest.NewRequest("GET", DefaultDebugPath, nil))
+	body := rec.Body.String()
+	_assert(t, strings.Contains(body, "<td align=center>1</td>\n\t\t\t<td align=center>1</td>"),
+		"debug page does not show the queue: %s", body)
+
+	var rejected, ok int
+	for i := 0; i < 3; i++ {
+		err := <-errs
+		switch {
+		case err == nil:
+			ok++
+		case IsResourceExhausted(err):
+			rejected++
+		default:
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+	_assert(t, ok == 2 && rejected == 1, "%d succeeded, %d rejected", ok, rejected)
+
+	// 全局限制同样生效，移除方法限制后不再排队
+	s.SetMethodConcurrencyLimit("Foo.Sleep", ConcurrencyLimit{})
+	s.SetConcurrencyLimit(ConcurrencyLimit{MaxConcurrency: 1})
+	for i := 0; i < 2; i++ {
+		c := dialTest(t, addr)
+		go func() {
+			var reply int
+			errs <- c.call("Foo.Sleep", Args{Num1: 100}, &reply)
+		}()
+		time.Sleep(20 * time.Millisecond)
+	}
+	err1, err2 := <-errs, <-errs
+	_assert(t, (err1 == nil) != (err2 == nil) && (IsResourceExhausted(err1) || IsResourceExhausted(err2)),
+		"unexpected errors: %v, %v", err1, err2)
+}
+
+func TestConcurrencyLimitTimeout(t *testing.T) {
+	s, addr := startServer(t)
+	lim := ConcurrencyLimit{MaxConcurrency: 1, MaxQueue: 1}
+	s.SetMethodConcurrencyLimit("Foo.Sleep", lim)
+	busy := dialTest(t, addr)
+	go func() {
+		var reply int
+		_ = busy.call("Foo.Sleep", Args{Num1: 500}, &reply)
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	// 排队等待的时间也计入HandleTimeout，超时后让出队列位置
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer conn.Close()
+	opt := *DefaultOption
+	opt.HandleTimeout = 100 * time.Millisecond
+	_ = json.NewEncoder(conn).Encode(&opt)
+	tc := &testConn{cc: codec.NewGobCodec(conn)}
+	start := time.Now()
+	var reply int
+	err = tc.call("Foo.Sleep", Args{Num1: 1}, &reply)
+	elapsed := time.Since(start)
+	_assert(t, err != nil && strings.Contains(err.Error(), "timeout") && elapsed < 300*time.Millisecond,
+		"queued request returned after %v: %v", elapsed, err)
+	v, _ := s.methodLimits.Load("Foo.Sleep")
+	_assert(t, v.(*limiter).Queued() == 0, "queue place not given up")
+}
+
+func TestRateLimit(t *testing.T) {
+	s, addr := startServer(t)
+	s.SetRateLimit("Foo.Sleep", RateLimit{Rate: 1, Burst: 2, Key: "tenant"})
+	a := dialTest(t, addr)
+	a.metadata = map[string]string{"tenant": "a"}
+	b := dialTest(t, addr)
+	b.metadata = map[string]string{"tenant": "b"}
+
+	// 每个租户有独立的令牌桶
+	var reply int
+	for i := 0; i < 2; i++ {
+		err := a.call("Foo.Sleep", Args{}, &reply)
+		_assert(t, err == nil, "call %d error: %v", i, err)
+	}
+	err := a.call("Foo.Sleep", Args{}, &reply)
+	retryAfter, ok := RetryAfter(err)
+	_assert(t, IsRateLimited(err) && ok && retryAfter > 0 && retryAfter <= time.Second,
+		"expected rate limited error with retry hint, got %v (%s)", err, retryAfter)
+	err = b.call("Foo.Sleep", Args{}, &reply)
+	_assert(t, err == nil, "other tenant limited: %v", err)
+	err = a.call("Health.Check", HealthCheckRequest{}, &HealthCheckResponse{})
+	_assert(t, err == nil, "other method limited: %v", err)
+
+	// 按对端限制整个服务器
+	s.SetRateLimit("Foo.Sleep", RateLimit{})
+	s.SetRateLimit("", RateLimit{Rate: 1, Burst: 1, Key: RateLimitByPeer})
+	err = a.call("Foo.Sleep", Args{}, &reply)
+	_assert(t, err == nil, "first call limited: %v", err)
+	err = b.call("Health.Check", HealthCheckRequest{}, &HealthCheckResponse{})
+	_assert(t, IsRateLimited(err), "expected peer to be limited, got %v", err)
+
+	// 被服务器限流拒绝的请求不消耗方法的令牌
+	s.SetRateLimit("", RateLimit{Rate: 1, Burst: 2})
+	s.SetRateLimit("Foo.Sleep", RateLimit{Rate: 0.001, Burst: 1})
+	_ = a.call("Health.Check", HealthCheckRequest{}, &HealthCheckResponse{})
+	_ = a.call("Health.Check", HealthCheckRequest{}, &HealthCheckResponse{})
+	err = a.call("Foo.Sleep", Args{}, &reply)
+	_assert(t, IsRateLimited(err), "expected server to be limited, got %v", err)
+	s.SetRateLimit("", RateLimit{})
+	err = a.call("Foo.Sleep", Args{}, &reply)
+	_assert(t, err == nil, "method token spent by a rejected request: %v", err)
+}
+
+type Who int
+
+func (w Who) Am(ctx context.Context, args int, reply *string) error {
+	*reply = IdentityFromContext(ctx)
+	return nil
+}
+
+func TestACL(t *testing.T) {
+	acl := ACL{
+		"alice": {"Foo.*", "*.Sum"},
+		"bob":   {"Foo.v2.Get"},
+		"root":  {"*"},
+		"*":     {"Foo.Sum"},
+	}
+	cases := []struct {
+		identity, serviceMethod string
+		want                    bool
+	}{
+		{"alice", "Foo.Delete", true},
+		// 服务名和方法名分开匹配，Foo.*不包括带点的服务Foo.v2
+		{"alice", "Foo.v2.Delete", false},
+		{"alice", "Foo.v2.Sum", true},
+		{"bob", "Foo.v2.Get", true},
+		{"bob", "Foo.v2.Delete", false},
+		{"root", "Foo.v2.Delete", true},
+		{"carol", "Foo.Sum", true},
+		{"carol", "Foo.Get", false},
+	}
+	for _, c := range cases {
+		got := acl.Allowed(c.identity, c.serviceMethod)
+		_assert(t, got == c.want, "Allowed(%q, %q) = %v", c.identity, c.serviceMethod, got)
+	}
+}
+
+func TestAuth(t *testing.T) {
+	s, addr := startServer(t)
+	var who Who
+	_ = s.Register(&who)
+	s.SetAuth(AnyAuth(
+		BearerTokenAuth(map[string]string{"secret-token": "alice"}),
+		HMACAuth(map[string][]byte{"bob": []byte("key")}, time.Minute),
+	), ACL{
+		"alice": {"Foo.*", "Who.Am"},
+		"bob":   {"Who.*"},
+		"*":     {"Health.Check"},
+	})
+	call := func(auth, serviceMethod string) (string, error) {
+		c := dialTest(t, addr)
+		c.metadata = map[string]string{AuthorizationKey: auth}
+		var reply string
+		var err error
+		switch serviceMethod {
+		case "Who.Am":
+			err = c.call(serviceMethod, 0, &reply)
+		case "Foo.Sleep":
+			err = c.call(serviceMethod, Args{}, new(int))
+		default:
+			err = c.call(serviceMethod, HealthCheckRequest{}, &HealthCheckResponse{})
+		}
+		return reply, err
+	}
+
+	// 令牌认证，处理函数从ctx得到身份
+	reply, err := call("Bearer secret-token", "Who.Am")
+	_assert(t, err == nil && reply == "alice", "bearer call: %q, %v", reply, err)
+	_, err = call("Bearer wrong", "Who.Am")
+	_assert(t, IsPermissionDenied(err), "expected unauthenticated, got %v", err)
+	_, err = call("", "Foo.Sleep")
+	_assert(t, IsPermissionDenied(err), "expected unauthenticated, got %v", err)
+
+	// HMAC签名认证，签名绑定方法和参数且有时效，每个nonce只能使用一次
+	sign := func(ts int64, nonce, serviceMethod string, args interface{}) string {
+		digest, _ := ArgsDigest(args)
+		return fmt.Sprintf("HMAC bob:%d:%s:%s", ts, nonce, HMACSignature([]byte("key"), "bob", ts, nonce, serviceMethod, digest))
+	}
+	ts := time.Now().Unix()
+	reply, err = call(sign(ts, "n1", "Who.Am", 0), "Who.Am")
+	_assert(t, err == nil && reply == "bob", "hmac call: %q, %v", reply, err)
+	_, err = call(sign(ts, "n1", "Who.Am", 0), "Who.Am")
+	_assert(t, IsPermissionDenied(err), "replayed signature accepted: %v", err)
+	_, err = call(sign(ts, "n2", "Who.Am", 0), "Health.Check")
+	_assert(t, IsPermissionDenied(err), "signature reused for another method: %v", err)
+	c := dialTest(t, addr)
+	c.metadata = map[string]string{AuthorizationKey: sign(ts, "n3", "Who.Am", 0)}
+	err = c.call("Who.Am", 1, &reply)
+	_assert(t, IsPermissionDenied(err), "signature reused for other arguments: %v", err)
+	old := ts - 3600
+	_, err = call(sign(old, "n4", "Who.Am", 0), "Who.Am")
+	_assert(t, IsPermissionDenied(err), "expired signature accepted: %v", err)
+
+	// 按ACL授权
+	_, err = call(sign(ts, "n5", "Foo.Sleep", Args{}), "Foo.Sleep")
+	var e *Error
+	_assert(t, errors.As(err, &e) && e.Code == CodePermissionDenied, "expected permission denied, got %v", err)
+	_, err = call("Bearer secret-token", "Health.Check")
+	_assert(t, err == nil, "wildcard identity denied: %v", err)
+}
@@ -1,8 +1,9 @@
 package server
 
 import (
+	"context"
+	"fmt"
 	"go/ast"
-	"log"
 	"reflect"
 	"sync/atomic"
 )
@@ -11,6 +12,7 @@ type methodType struct {
 	method reflect.Method
 	ArgType reflect.Type
 	ReplyType reflect.Type
+	withContext bool // the method takes a context.Context before its args
 	numCalls uint64
 }
 
@@ -41,35 +43,62 @@ func (m *methodType) newReplyv() reflect.Value {
 
 type Service struct {
 	name string
+	version string
 	typ reflect.Type
 	rcvr reflect.Value
 	method map[string]*methodType
 }
 
-func NewService(rcvr interface{}) *Service {
+func NewService(rcvr interface{}) (*Service, error) {
+	return newService(reflect.Indirect(reflect.ValueOf(rcvr)).Type().Name(), rcvr)
+}
+
+func newService(name string, rcvr interface{}) (*Service, error) {
 	s := new(Service)
 	s.rcvr = reflect.ValueOf(rcvr)
-	s.name = reflect.Indirect(s.rcvr).Type().Name()
+	s.name = name
 	s.typ = reflect.TypeOf(rcvr)
 	if !ast.IsExported(s.name) {
-		log.Fatalf("rpc server: %s is not a valid service name", s.name)
+		return nil, fmt.Errorf("rpc server: %q is not a valid service name", s.name)
 	}
 	s.registerMethods()
-	return s
+	if len(s.method) == 0 {
+		return nil, fmt.Errorf("rpc server: %s has no exported methods of suitable type", s.name)
+	}
+	return s, nil
+}
+
+// key is the name the service is registered under: its name, followed by
+// "@" and its version if it has one.
+func (s *Service) key() string {
+	if s.version == "" {
+		return s.name
+	}
+	return s.name + "@" + s.version
 }
 
+var typeOfContext = reflect.TypeOf((*context.Context)(nil)).Elem()
+
+// registerMethods registers the methods of the form
+//
+//	func (t *T) Method(args Args, reply *Reply) error
+//	func (t *T) Method(ctx context.Context, args Args, reply *Reply) error
+//
+// The context of the second form carries the Peer of the request and is
+// done when the handle timeout of the connection expires.
 func (s *Service) registerMethods() {
 	s.method = make(map[string]*methodType)
 	for i := 0; i < s.typ.NumMethod(); i++ {
 		method := s.typ.Method(i)
 		mType := method.Type
-		if mType.NumIn() != 3 || mType.NumOut() != 1 {
+		withContext := mType.NumIn() == 4 && mType.In(1) == typeOfContext
+		if (mType.NumIn() != 3 && !withContext) || mType.NumOut() != 1 {
 			continue
 		}
 		if mType.Out(0) != reflect.TypeOf((*error)(nil)).Elem() {
 			continue
 		}
-		argType, replyType := mType.In(1), mType.In(2)
+		argType, replyType := mType.In(mType.NumIn()-2), mType.In(mType.NumIn()-1)
 		if !isExportedOrBuiltinType(argType) || !isExportedOrBuiltinType(replyType) {
 			continue
 		}
@@ -77,8 +106,8 @@ func (s *Service) registerMethods() {
 			method: method,
 			ArgType: argType,
 			ReplyType: replyType,
+			withContext: withContext,
 		}
-		log.Printf("rpc server: register %s.%s\n", s.name, method.Name)
 	}
 }
 
@@ -86,10 +115,14 @@ func isExportedOrBuiltinType(t reflect.Type) bool {
 	return ast.IsExported(t.Name()) || t.PkgPath() == ""
 }
 
-func (s *Service) call(m *methodType, argv, replyv reflect.Value) error {
+func (s *Service) call(ctx context.Context, m *methodType, argv, replyv reflect.Value) error {
 	atomic.AddUint64(&m.numCalls, 1)
 	f := m.method.Func
-	returnValues := f.Call([]reflect.Value{s.rcvr, argv, replyv})
+	in := []reflect.Value{s.rcvr, argv, replyv}
+	if m.withContext {
+		in = []reflect.Value{s.rcvr, reflect.ValueOf(ctx), argv, replyv}
+	}
+	returnValues := f.Call(in)
 	if errInter := returnValues[0].Interface(); errInter != nil {
 		return errInter.(error)
 	}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"errors"
+	"time"
+)
+
+// Status codes sent in the response header when a request is rejected by
+// the server itself rather than failed by the service.
+const (
+	CodeResourceExhausted = "RESOURCE_EXHAUSTED"
+	CodeRateLimited       = "RATE_LIMITED"
+	CodeUnauthenticated   = "UNAUTHENTICATED"
+	CodePermissionDenied  = "PERMISSION_DENIED"
+)
+
+// Error is an error carrying a status code. Clients receive it for
+// requests whose response header has a code.
+type Error struct {
+	Code       string
+	Msg        string
+	RetryAfter time.Duration // when to retry a rejected request, 0 if unknown
+}
+
+func (e *Error) Error() string {
+	return e.Msg
+}
+
+// IsResourceExhausted reports whether err is a request rejected because
+// the server or the method was at its concurrency limit.
+func IsResourceExhausted(err error) bool {
+	var e *Error
+	return errors.As(err, &e) && e.Code == CodeResourceExhausted
+}
+
+// IsRateLimited reports whether err is a request rejected by a rate limit.
+func IsRateLimited(err error) bool {
+	var e *Error
+	return errors.As(err, &e) && e.Code == CodeRateLimited
+}
+
+// RetryAfter returns how long to wait before retrying the request that
+// failed with err, as hinted by the server. It reports false if the
+// server gave no hint.
+func RetryAfter(err error) (time.Duration, bool) {
+	var e *Error
+	if errors.As(err, &e) && e.RetryAfter > 0 {
+		return e.RetryAfter, true
+	}
+	return 0, false
+}
+
+// IsPermissionDenied reports whether err is a request rejected because its
+// caller could not be authenticated or is not allowed to call the method.
+func IsPermissionDenied(err error) bool {
+	var e *Error
+	return errors.As(err, &e) && (e.Code == CodeUnauthenticated || e.Code == CodePermissionDenied)
+}
@@ -0,0 +1,226 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// version is a semantic version major.minor.patch[-prerelease]. Build
+// metadata is accepted but dropped, as it does not affect precedence.
+type version struct {
+	major, minor, patch int
+	pre                 string
+}
+
+// parseVersion parses a version such as "1.2.3", "v1.2.3", "1.2.3-rc.1" or
+// "1.2.3+build.5".
+// With partial set, missing minor and patch numbers, or "x" and "*" in
+// their place, are allowed and reported by the number of parts given.
+func parseVersion(s string, partial bool) (v version, parts int, err error) {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "v")
+	if i := strings.IndexByte(s, '+'); i >= 0 {
+		if i == len(s)-1 {
+			return v, 0, fmt.Errorf("rpc: invalid version %q", s)
+		}
+		s = s[:i]
+	}
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		s, v.pre = s[:i], s[i+1:]
+	}
+	fields := strings.Split(s, ".")
+	if len(fields) > 3 || (!partial && len(fields) != 3) {
+		return v, 0, fmt.Errorf("rpc: invalid version %q", s)
+	}
+	nums := []*int{&v.major, &v.minor, &v.patch}
+	for i, f := range fields {
+		if partial && (f == "x" || f == "X" || f == "*") {
+			return v, i, nil
+		}
+		n, err := strconv.Atoi(f)
+		if err != nil || n < 0 {
+			return v, 0, fmt.Errorf("rpc: invalid version %q", s)
+		}
+		*nums[i] = n
+	}
+	return v, len(fields), nil
+}
+
+func (v version) compare(o version) int {
+	for _, d := range []int{v.major - o.major, v.minor - o.minor, v.patch - o.patch} {
+		if d != 0 {
+			return d
+		}
+	}
+	switch {
+	case v.pre == o.pre:
+		return 0
+	case v.pre == "":
+		return 1
+	case o.pre == "":
+		return -1
+	}
+	return comparePrerelease(v.pre, o.pre)
+}
+
+// comparePrerelease compares pre-release versions identifier by identifier:
+// numerically when both are numeric, numeric ones being lower than the
+// others, and as strings otherwise. A prefix is lower than the longer
+// version, so that rc < rc.1 < rc.2 < rc.10 < rc.x.
+func comparePrerelease(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		an, aerr := strconv.ParseUint(as[i], 10, 64)
+		bn, berr := strconv.ParseUint(bs[i], 10, 64)
+		switch {
+		case aerr == nil && berr == nil:
+			if an != bn {
+				if an < bn {
+					return -1
+				}
+				return 1
+			}
+		case aerr == nil:
+			return -1
+		case berr == nil:
+			return 1
+		default:
+			if d := strings.Compare(as[i], bs[i]); d != 0 {
+				return d
+			}
+		}
+	}
+	return len(as) - len(bs)
+}
+
+// ValidVersion reports whether s is a valid semantic version.
+func ValidVersion(s string) bool {
+	_, _, err := parseVersion(s, false)
+	return err == nil
+}
+
+// CompareVersions compares two valid versions, returning a negative number,
+// zero or a positive number when a is lower than, equal to or higher than b.
+func CompareVersions(a, b string) int {
+	va, _, _ := parseVersion(a, false)
+	vb, _, _ := parseVersion(b, false)
+	return va.compare(vb)
+}
+
+// MatchVersion reports whether version satisfies constraint. A constraint
+// is a list of alternatives separated by "||", each a space-separated list
+// of comparisons that must all hold:
+//
+//	1.2.3  =1.2.3       exactly 1.2.3
+//	1.2  1.2.x  ~1.2    >=1.2.0 <1.3.0
+//	^1.2.3              >=1.2.3 <2.0.0 (>=0.2.3 <0.3.0 for ^0.2.3)
+//	~1.2.3              >=1.2.3 <1.3.0
+//	>1.2 >=1.2 <2 <=2   comparisons with the missing parts as zero
+//	* or empty          any version
+//
+// Pre-releases only match alternatives naming a pre-release of the same
+// major.minor.patch, such as ">=2.0.0-rc.1 <2.1". An invalid version or
+// constraint never matches.
+func MatchVersion(ver, constraint string) bool {
+	v, _, err := parseVersion(ver, false)
+	if err != nil {
+		return false
+	}
+	for _, alt := range strings.Split(constraint, "||") {
+		ok, err := matchAll(v, strings.Fields(alt))
+		if err != nil {
+			return false
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+// matchAll reports whether v satisfies all the comparisons. A pre-release
+// only does if one of them names a pre-release of the same major.minor.patch,
+// so that "^1.2" or "<2" never pick 2.0.0-rc.1.
+func matchAll(v version, comparisons []string) (bool, error) {
+	named := v.pre == ""
+	for _, c := range comparisons {
+		ok, err := matchOne(v, c)
+		if err != nil || !ok {
+			return false, err
+		}
+		named = named || namesPrerelease(v, c)
+	}
+	return named, nil
+}
+
+// namesPrerelease reports whether the comparison c names a pre-release of
+// the same major.minor.patch as v.
+func namesPrerelease(v version, c string) bool {
+	op := strings.TrimRight(c[:min(len(c), 2)], "0123456789vxX*.")
+	lo, parts, err := parseVersion(c[len(op):], true)
+	return err == nil && parts == 3 && lo.pre != "" &&
+		lo.major == v.major && lo.minor == v.minor && lo.patch == v.patch
+}
+
+func matchOne(v version, c string) (bool, error) {
+	op := strings.TrimRight(c[:min(len(c), 2)], "0123456789vxX*.")
+	c = c[len(op):]
+	if c == "*" || c == "x" || c == "X" {
+		return op == "" || op == "=" || op == ">=" || op == "<=", nil
+	}
+	lo, parts, err := parseVersion(c, true)
+	if err != nil {
+		return false, err
+	}
+	// hi is the exclusive upper bound of the range the partial version
+	// stands for
+	hi := lo
+	hi.pre = ""
+	switch parts {
+	case 0:
+		return true, nil
+	case 1:
+		hi = version{major: lo.major + 1}
+	case 2:
+		hi = version{major: lo.major, minor: lo.minor + 1}
+	case 3:
+		hi = version{major: lo.major, minor: lo.minor, patch: lo.patch + 1}
+	}
+	switch op {
+	case "", "=":
+		if parts == 3 {
+			return v.compare(lo) == 0, nil
+		}
+		return v.compare(lo) >= 0 && v.compare(hi) < 0, nil
+	case ">":
+		if parts == 3 {
+			return v.compare(lo) > 0, nil
+		}
+		return v.compare(hi) >= 0, nil
+	case ">=":
+		return v.compare(lo) >= 0, nil
+	case "<":
+		return v.compare(lo) < 0, nil
+	case "<=":
+		if parts == 3 {
+			return v.compare(lo) <= 0, nil
+		}
+		return v.compare(hi) < 0, nil
+	case "~":
+		if parts == 1 {
+			return v.compare(lo) >= 0 && v.compare(hi) < 0, nil
+		}
+		return v.compare(lo) >= 0 && v.compare(version{major: lo.major, minor: lo.minor + 1}) < 0, nil
+	case "^":
+		switch {
+		case lo.major > 0 || parts == 1:
+			hi = version{major: lo.major + 1}
+		case lo.minor > 0 || parts == 2:
+			hi = version{minor: lo.minor + 1}
+		default:
+			hi = version{patch: lo.patch + 1}
+		}
+		return v.compare(lo) >= 0 && v.compare(hi) < 0, nil
+	}
+	return false, fmt.Errorf("rpc: invalid version constraint %q", op+c)
+}
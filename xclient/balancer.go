@@ -0,0 +1,435 @@
+package xclient
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type SelectMode int
+
+const (
+	RandomSelect SelectMode = iota
+	RoundRobinSelect
+	WeightRoundRobinSelect
+	ConsistentHashSelect
+	LeastRequestSelect // fewest outstanding calls
+	P2CSelect          // power of two choices on EWMA latency and outstanding calls
+)
+
+// PickInfo describes the call a Balancer picks a server for.
+type PickInfo struct {
+	Ctx           context.Context
+	ServiceMethod string
+	Args          interface{}
+	Key           string // routing key from WithHashKey or the XClient's KeyFunc
+}
+
+// Feedback receives the outcome of calls. Start is called when a call is
+// sent to addr and Done when it completes. err is nil unless the call
+// failed because of the server, or context.Canceled if the caller
+// abandoned it.
+type Feedback interface {
+	Start(addr string)
+	Done(addr string, latency time.Duration, err error)
+}
+
+// Pruner is implemented by balancers keeping state per server. XClient
+// calls Prune with all the servers of the discovery so that the state of
+// the servers that left it is dropped.
+type Pruner interface {
+	Prune(servers []string)
+}
+
+// Balancer picks one of the servers returned by a Discovery for each call.
+// servers is never empty.
+type Balancer interface {
+	Pick(servers []string, info *PickInfo) (string, error)
+	Feedback
+}
+
+// NewBalancer returns the built-in balancer for mode. w provides the server
+// weights for WeightRoundRobinSelect and may be nil, giving every server
+// the same weight. replicas is the number of virtual nodes per server for
+// ConsistentHashSelect; 0 uses the default.
+func NewBalancer(mode SelectMode, w Weigher, replicas int) Balancer {
+	switch mode {
+	case RandomSelect:
+		return &randomBalancer{r: newRand()}
+	case RoundRobinSelect:
+		return &roundRobinBalancer{index: newRand().Intn(math.MaxInt32 - 1)}
+	case WeightRoundRobinSelect:
+		return &weightedRoundRobinBalancer{w: w, current: make(map[string]int)}
+	case ConsistentHashSelect:
+		return NewConsistentHashBalancer(replicas)
+	case LeastRequestSelect:
+		return &leastRequestBalancer{loadTracker: newLoadTracker()}
+	case P2CSelect:
+		return &p2cBalancer{loadTracker: newLoadTracker()}
+	default:
+		return unsupportedBalancer{}
+	}
+}
+
+func newRand() *rand.Rand {
+	return rand.New(rand.NewSource(time.Now().UnixNano()))
+}
+
+// noFeedback is embedded by balancers that ignore call outcomes.
+type noFeedback struct{}
+
+func (noFeedback) Start(addr string)                                  {}
+func (noFeedback) Done(addr string, latency time.Duration, err error) {}
+
+type unsupportedBalancer struct {
+	noFeedback
+}
+
+func (unsupportedBalancer) Pick(servers []string, info *PickInfo) (string, error) {
+	return "", errors.New("rpc discovery: not supported select mode")
+}
+
+type randomBalancer struct {
+	noFeedback
+	mu sync.Mutex
+	r  *rand.Rand
+}
+
+func (b *randomBalancer) Pick(servers []string, info *PickInfo) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return servers[b.r.Intn(len(servers))], nil
+}
+
+type roundRobinBalancer struct {
+	noFeedback
+	mu    sync.Mutex
+	index int
+}
+
+func (b *roundRobinBalancer) Pick(servers []string, info *PickInfo) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := len(servers)
+	s := servers[b.index%n]
+	b.index = (b.index + 1) % n
+	return s, nil
+}
+
+// weightedRoundRobinBalancer is the smooth weighted round robin used by nginx.
+type weightedRoundRobinBalancer struct {
+	noFeedback
+	mu      sync.Mutex
+	w       Weigher
+	current map[string]int
+}
+
+func (b *weightedRoundRobinBalancer) weight(addr string) int {
+	if b.w == nil {
+		return 1
+	}
+	return b.w.Weight(addr)
+}
+
+func (b *weightedRoundRobinBalancer) Pick(servers []string, info *PickInfo) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.current) > len(servers) {
+		current := make(map[string]int, len(servers))
+		for _, s := range servers {
+			current[s] = b.current[s]
+		}
+		b.current = current
+	}
+	totalWeight := 0
+	var selected string
+	for _, s := range servers {
+		w := b.weight(s)
+		totalWeight += w
+		b.current[s] += w
+		if selected == "" || b.current[s] > b.current[selected] {
+			selected = s
+		}
+	}
+	b.current[selected] -= totalWeight
+	return selected, nil
+}
+
+type consistentHashBalancer struct {
+	noFeedback
+	mu      sync.Mutex
+	r       *rand.Rand
+	ring    *ConsistentHash
+	servers []string
+}
+
+// NewConsistentHashBalancer returns a balancer that maps the routing key of
+// each call onto a hash ring with the given number of virtual nodes per
+// server. Calls without a key are spread randomly.
+func NewConsistentHashBalancer(replicas int) Balancer {
+	return &consistentHashBalancer{r: newRand(), ring: NewConsistentHash(replicas, nil)}
+}
+
+func (b *consistentHashBalancer) Pick(servers []string, info *PickInfo) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !slices.Equal(b.servers, servers) {
+		b.servers = slices.Clone(servers)
+		b.ring.Set(servers)
+	}
+	key := info.Key
+	if key == "" {
+		key = strconv.Itoa(b.r.Int())
+	}
+	return b.ring.Get(key)
+}
+
+const (
+	ewmaAlpha      = 0.3
+	failurePenalty = time.Second
+)
+
+type serverLoad struct {
+	inflight int64
+	ewma     float64 // latency in nanoseconds
+}
+
+// score estimates the cost of sending one more call to the server.
+func (l *serverLoad) score() float64 {
+	return l.ewma * float64(l.inflight+1)
+}
+
+// loadTracker records outstanding calls and an EWMA of the latency of
+// each server.
+type loadTracker struct {
+	mu    sync.Mutex
+	r     *rand.Rand
+	loads map[string]*serverLoad
+}
+
+func newLoadTracker() loadTracker {
+	return loadTracker{r: newRand(), loads: make(map[string]*serverLoad)}
+}
+
+func (t *loadTracker) load(addr string) *serverLoad {
+	l, ok := t.loads[addr]
+	if !ok {
+		l = &serverLoad{}
+		t.loads[addr] = l
+	}
+	return l
+}
+
+func (t *loadTracker) Start(addr string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.load(addr).inflight++
+}
+
+func (t *loadTracker) Done(addr string, latency time.Duration, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	l := t.load(addr)
+	if l.inflight > 0 {
+		l.inflight--
+	}
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	if err != nil && latency < failurePenalty {
+		latency = failurePenalty
+	}
+	if l.ewma == 0 {
+		l.ewma = float64(latency)
+	} else {
+		l.ewma = ewmaAlpha*float64(latency) + (1-ewmaAlpha)*l.ewma
+	}
+}
+
+func (t *loadTracker) Prune(servers []string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	keep := make(map[string]bool, len(servers))
+	for _, addr := range servers {
+		keep[addr] = true
+	}
+	for addr := range t.loads {
+		if !keep[addr] {
+			delete(t.loads, addr)
+		}
+	}
+}
+
+type leastRequestBalancer struct {
+	loadTracker
+}
+
+func (b *leastRequestBalancer) Pick(servers []string, info *PickInfo) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := len(servers)
+	start := b.r.Intn(n)
+	selected := servers[start]
+	for i := 1; i < n; i++ {
+		s := servers[(start+i)%n]
+		if b.load(s).inflight < b.load(selected).inflight {
+			selected = s
+		}
+	}
+	return selected, nil
+}
+
+type p2cBalancer struct {
+	loadTracker
+}
+
+func (b *p2cBalancer) Pick(servers []string, info *PickInfo) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := len(servers)
+	if n == 1 {
+		return servers[0], nil
+	}
+	i := b.r.Intn(n)
+	j := b.r.Intn(n - 1)
+	if j >= i {
+		j++
+	}
+	x, y := servers[i], servers[j]
+	if b.load(y).score() < b.load(x).score() {
+		return y, nil
+	}
+	return x, nil
+}
+
+type ConsistentHash struct {
+	mu          sync.RWMutex
+	hashFunc    func(data []byte) uint32
+	replicas    int
+	keys        []uint32
+	hash2Server map[uint32]string
+	servers     []string
+}
+
+func NewConsistentHash(replicas int, servers []string) *ConsistentHash {
+	if replicas <= 0 {
+		replicas = 50
+	}
+
+	hash := ConsistentHash{
+		replicas: replicas,
+		hashFunc: defaultHash,
+	}
+	hash.Set(servers)
+	return &hash
+}
+
+// Set rebuilds the ring from scratch with the given servers.
+func (c *ConsistentHash) Set(servers []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.keys = c.keys[:0]
+	c.hash2Server = make(map[uint32]string)
+	c.servers = make([]string, 0, len(servers))
+	for _, server := range servers {
+		c.add(server)
+	}
+	c.sortKeys()
+}
+
+func (c *ConsistentHash) add(server string) {
+	for i := 0; i < c.replicas; i++ {
+		virtualKey := fmt.Sprintf("%s-%d", server, i)
+		hash := c.hashFunc([]byte(virtualKey))
+		c.keys = append(c.keys, hash)
+		c.hash2Server[hash] = server
+	}
+	c.servers = append(c.servers, server)
+}
+
+func (c *ConsistentHash) sortKeys() {
+	sort.Slice(c.keys, func(i, j int) bool {
+		return c.keys[i] < c.keys[j]
+	})
+}
+
+func defaultHash(data []byte) uint32 {
+	hash := md5.Sum(data)
+	return binary.BigEndian.Uint32(hash[:4])
+}
+
+func (c *ConsistentHash) AddServer(server string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	isExist := false
+	for _, v := range c.servers {
+		if v == server {
+			isExist = true
+			break
+		}
+	}
+	if isExist {
+		return errors.New("rpc discovery: server already exist")
+	}
+	c.add(server)
+	c.sortKeys()
+	return nil
+}
+
+func (c *ConsistentHash) RemoveServer(server string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	idx := -1
+	for i, v := range c.servers {
+		if v == server {
+			idx = i
+			break
+		}
+	}
+	if idx < 0 {
+		return errors.New("rpc discovery: server not exist")
+	}
+
+	for i := 0; i < c.replicas; i++ {
+		virtualKey := fmt.Sprintf("%s-%d", server, i)
+		hash := c.hashFunc([]byte(virtualKey))
+		delete(c.hash2Server, hash)
+	}
+
+	c.keys = c.keys[:0]
+	for hash := range c.hash2Server {
+		c.keys = append(c.keys, hash)
+	}
+	c.sortKeys()
+	c.servers = append(c.servers[:idx], c.servers[idx+1:]...)
+	return nil
+}
+
+func (c *ConsistentHash) Get(key string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.keys) == 0 {
+		return "", errors.New("no servers available")
+	}
+
+	hash := c.hashFunc([]byte(key))
+	idx := sort.Search(len(c.keys), func(i int) bool {
+		return c.keys[i] >= hash
+	})
+
+	if idx == len(c.keys) {
+		idx = 0
+	}
+	return c.hash2Server[c.keys[idx]], nil
+}
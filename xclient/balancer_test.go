@@ -0,0 +1,155 @@
+package xclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"gorpc/client"
+	"gorpc/server"
+)
+
+func pick(b Balancer, servers []string, key string) string {
+	addr, _ := b.Pick(servers, &PickInfo{Key: key})
+	return addr
+}
+
+func TestConsistentHashBalancer(t *testing.T) {
+	servers := []string{"tcp@a:1", "tcp@b:2", "tcp@c:3"}
+	b := NewBalancer(ConsistentHashSelect, nil, 0)
+
+	// 相同的key总是落到同一台服务器
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("user-%d", i)
+		first := pick(b, servers, key)
+		_assert(t, first != "", "no server picked for key %s", key)
+		for j := 0; j < 5; j++ {
+			addr := pick(b, servers, key)
+			_assert(t, addr == first, "key %s moved from %s to %s", key, first, addr)
+		}
+	}
+
+	// 服务器列表变化后哈希环同步，被移除的服务器不再被选中
+	before := make(map[string]string)
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("user-%d", i)
+		before[key] = pick(b, servers, key)
+	}
+	servers = []string{"tcp@a:1", "tcp@c:3"}
+	for key, old := range before {
+		addr := pick(b, servers, key)
+		_assert(t, addr != "tcp@b:2", "removed server selected for key %s", key)
+		if old != "tcp@b:2" {
+			_assert(t, addr == old, "key %s moved from %s to %s", key, old, addr)
+		}
+	}
+}
+
+func TestConsistentHashReplicas(t *testing.T) {
+	// NewXClient使用服务发现配置的虚拟节点数
+	d := NewMultiServerDiscovery([]string{"tcp@a:1"}, []int{1}, 100, 20)
+	xc := NewXClient(d, ConsistentHashSelect, nil)
+	b, ok := xc.b.(*consistentHashBalancer)
+	_assert(t, ok && b.ring.replicas == 20, "replicas not passed to the balancer")
+}
+
+func TestWeightedRoundRobinBalancer(t *testing.T) {
+	servers := []string{"tcp@a:1", "tcp@b:2"}
+	d := NewMultiServerDiscovery(servers, []int{3, 1}, 100, 50)
+	b := NewBalancer(WeightRoundRobinSelect, d, 0)
+
+	counts := make(map[string]int)
+	for i := 0; i < 40; i++ {
+		counts[pick(b, servers, "")]++
+	}
+	_assert(t, counts["tcp@a:1"] == 30 && counts["tcp@b:2"] == 10, "unexpected distribution: %v", counts)
+}
+
+func TestWeightedRoundRobinRecovery(t *testing.T) {
+	servers := []string{"tcp@a:1", "tcp@b:2"}
+	d := NewMultiServerDiscovery(servers, []int{1, 1}, 100, 50)
+	b := NewBalancer(WeightRoundRobinSelect, d, 0)
+
+	// 失败后权重不低于1，节点仍会被选中并通过成功恢复权重
+	_ = d.MarkFailure("tcp@a:1")
+	_ = d.MarkFailure("tcp@a:1")
+	_assert(t, d.Weight("tcp@a:1") == 1, "weight dropped to %d", d.Weight("tcp@a:1"))
+	counts := make(map[string]int)
+	for i := 0; i < 10; i++ {
+		counts[pick(b, servers, "")]++
+	}
+	_assert(t, counts["tcp@a:1"] == 5, "failed server left the rotation: %v", counts)
+
+	// 权重为0的节点仍然不被选中
+	_ = d.UpdateWeight(0, "tcp@b:2")
+	_ = d.MarkFailure("tcp@b:2")
+	_assert(t, d.Weight("tcp@b:2") == 0, "zero weight raised to %d", d.Weight("tcp@b:2"))
+}
+
+func TestLoadAwareBalancers(t *testing.T) {
+	servers := []string{"tcp@a:1", "tcp@b:2"}
+
+	// a上有两个未完成的请求，最少请求策略应选择b
+	b := NewBalancer(LeastRequestSelect, nil, 0)
+	b.Start("tcp@a:1")
+	b.Start("tcp@a:1")
+	for i := 0; i < 10; i++ {
+		addr := pick(b, servers, "")
+		_assert(t, addr == "tcp@b:2", "least request selected %s", addr)
+	}
+
+	// b的延迟明显更高，P2C应选择a
+	b = NewBalancer(P2CSelect, nil, 0)
+	b.Start("tcp@a:1")
+	b.Done("tcp@a:1", time.Millisecond, nil)
+	b.Start("tcp@b:2")
+	b.Done("tcp@b:2", 100*time.Millisecond, nil)
+	for i := 0; i < 10; i++ {
+		addr := pick(b, servers, "")
+		_assert(t, addr == "tcp@a:1", "p2c selected %s", addr)
+	}
+
+	// 失败按惩罚延迟计入
+	b.Start("tcp@a:1")
+	b.Done("tcp@a:1", time.Millisecond, errors.New("boom"))
+	addr := pick(b, servers, "")
+	_assert(t, addr == "tcp@b:2", "p2c selected failing server %s", addr)
+
+	// 调用方放弃的调用只减少未完成数，不计入延迟
+	lt := &b.(*p2cBalancer).loadTracker
+	ewma := lt.loads["tcp@b:2"].ewma
+	b.Start("tcp@b:2")
+	b.Done("tcp@b:2", time.Microsecond, context.Canceled)
+	_assert(t, lt.loads["tcp@b:2"].ewma == ewma && lt.loads["tcp@b:2"].inflight == 0, "canceled call counted")
+
+	// 离开服务发现的服务器的状态被清除
+	b.(Pruner).Prune([]string{"tcp@b:2"})
+	_, ok := lt.loads["tcp@a:1"]
+	_assert(t, !ok && len(lt.loads) == 1, "loads not pruned: %v", lt.loads)
+}
+
+func TestServerFailure(t *testing.T) {
+	ctx := context.Background()
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	boom := errors.New("boom")
+	cases := []struct {
+		ctx  context.Context
+		err  error
+		want error
+	}{
+		{ctx, nil, nil},
+		{ctx, boom, boom},
+		// 服务自身返回的错误、限流和无权限不算服务器故障
+		{ctx, client.ServerError("rpc server: boom"), nil},
+		{ctx, &server.Error{Code: server.CodeRateLimited, Msg: "limited"}, nil},
+		// 调用方取消的调用报告为context.Canceled
+		{canceled, boom, context.Canceled},
+	}
+	for i, c := range cases {
+		got := serverFailure(c.ctx, c.err)
+		_assert(t, got == c.want, "case %d: got %v, want %v", i, got, c.want)
+	}
+}
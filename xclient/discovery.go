@@ -2,186 +2,93 @@ package xclient
 
 import (
 	"errors"
-	"math"
-	"math/rand"
 	"sync"
-	"time"
 	"fmt"
-	"crypto/md5"
-	"sort"
-	"encoding/binary"
-	"strconv"
-)
-
-type SelectMode int
-
-const (
-	RandomSelect SelectMode = iota
-	RoundRobinSelect
-	WeightRoundRobinSelect
-	ConsistentHashSelect
 )
 
+// Discovery manages the server list. Choosing one of the servers for a
+// call is left to a Balancer.
 type Discovery interface {
 	Refresh() error
 	Update(servers []string) error
-	Get(mode SelectMode) (string, error)
 	GetAll() ([]string, error)
 }
 
-type MultiServerDiscovery struct {
-	r       *rand.Rand
-	mu      sync.RWMutex
-	servers []string
-	index   int
-	currentWeights []int
-	effectiveWeights []int
-	maxWeight int
-	consistentHash *ConsistentHash
+// ServiceDiscovery is implemented by discoveries that know which services
+// and versions each server offers. XClient uses it to route calls only to
+// servers offering the service called, in the version asked for through
+// client.WithVersion if any.
+type ServiceDiscovery interface {
+	GetService(service, version string) ([]string, error)
 }
 
-type ConsistentHash struct {
-	mu sync.RWMutex
-	hashFunc func(data []byte) uint32
-	replicas int
-	keys []uint32
-	hash2Server map[uint32]string
-	servers []string
+// Weigher is implemented by discoveries that know the weight of each
+// server; the weighted round robin balancer uses it.
+type Weigher interface {
+	Weight(addr string) int
 }
 
-func NewConsistentHash(replicas int, servers []string) *ConsistentHash {
-	if replicas <= 0 {
-		replicas = 50
-	}
-
-	hash := ConsistentHash{
-		replicas: replicas,
-		hash2Server: make(map[uint32]string),
-		servers: make([]string, len(servers)),
-		hashFunc: defaultHash,
-	}
-	copy(hash.servers, servers)
-	return &hash
+// Replicator is implemented by discoveries that configure the number of
+// virtual nodes per server; the consistent hash balancer uses it.
+type Replicator interface {
+	Replicas() int
 }
 
-func defaultHash(data []byte) uint32 {
-	hash := md5.Sum(data)
-	return binary.BigEndian.Uint32(hash[:4])
+type MultiServerDiscovery struct {
+	mu      sync.RWMutex
+	servers []string
+	weights []int
+	effectiveWeights []int
+	maxWeight int
+	replicas  int
 }
 
-func (c *ConsistentHash) AddServer(server string) error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	isExist := false
-	for _, v := range c.servers {
-		if v == server {
-			isExist = true
-			break
-		}
-	}
-	if isExist {
-		return errors.New("rpc discovery: server already exist")
-	}
-	for i := 0; i < c.replicas; i++ {
-		virtualKey := fmt.Sprintf("%s-%d", server, i)
-		hash := c.hashFunc([]byte(virtualKey))
-		c.keys = append(c.keys, hash)
-		c.hash2Server[hash] = server
+func NewMultiServerDiscovery(servers []string, weights []int, maxWeight int, replicas int) *MultiServerDiscovery {
+	d := &MultiServerDiscovery{
+		maxWeight: maxWeight,
+		replicas:  replicas,
 	}
-	
-	sort.Slice(c.keys, func(i, j int) bool {
-		return c.keys[i] < c.keys[j]
-	})
-	c.servers = append(c.servers, server)
-	return nil
+	d.weights = make([]int, len(servers))
+	copy(d.weights, weights)
+	d.servers = servers
+	d.effectiveWeights = make([]int, len(servers))
+	copy(d.effectiveWeights, d.weights)
+	return d
 }
 
-func (c *ConsistentHash) RemoveServer(server string) error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-
-	isExist := false
-	for _, v := range c.servers {
-		if v == server {
-			isExist = true
-			break
-		}
-	}
-	if !isExist {
-		return errors.New("rpc discovery: server not exist")
-	}
-	
-	for i := 0; i < c.replicas; i++ {
-		virtualKey := fmt.Sprintf("%s-%d", server, i)
-		hash := c.hashFunc([]byte(virtualKey))
-		delete(c.hash2Server, hash)
-	}
-
-	c.keys = c.keys[:0]
-	for hash := range c.hash2Server {
-		c.keys = append(c.keys, hash)
-	}
-	sort.Slice(c.keys, func(i, j int) bool {
-		return c.keys[i] < c.keys[j]
-	})
-	c.servers = c.servers[:len(c.servers)-1]
-	return nil
+// Replicas returns the number of virtual nodes per server used by
+// ConsistentHashSelect.
+func (d *MultiServerDiscovery) Replicas() int {
+	return d.replicas
 }
 
-func (c *ConsistentHash) Get(key string) (string, error) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-
-	if len(c.keys) == 0 {
-		return "", errors.New("no servers available")
-	}
-
-	hash := c.hashFunc([]byte(key))
-	idx := sort.Search(len(c.keys), func(i int) bool {
-		return c.keys[i] >= hash
-	})
-
-	if idx == len(c.keys) {
-		idx = 0
-	}
-	return c.hash2Server[c.keys[idx]], nil
+func (d *MultiServerDiscovery) Weight(name string) int {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	w, _ := d.weight(name)
+	return w
 }
 
-func NewMultiServerDiscovery(servers []string, weights []int, maxWeight int, replicas int) *MultiServerDiscovery {
-	d := &MultiServerDiscovery{
-		servers: servers,
-		r:       rand.New(rand.NewSource(time.Now().UnixNano())),
-		effectiveWeights: make([]int, len(servers)),
-		currentWeights: make([]int, len(servers)),
-		maxWeight: maxWeight,
-		consistentHash: NewConsistentHash(replicas, servers),
+// weight returns the effective weight of name, reporting whether it is
+// one of the servers. Callers must hold d.mu.
+func (d *MultiServerDiscovery) weight(name string) (int, bool) {
+	for idx, value := range d.servers {
+		if value == name {
+			return d.effectiveWeights[idx], true
+		}
 	}
-	d.index = d.r.Intn(math.MaxInt32 - 1)
-	copy(d.effectiveWeights, weights)
-	
-	return d
+	return 0, false
 }
 
-func (d *MultiServerDiscovery) Next() (string, error) {
-	totalWeight := 0
-	var selected string
-	var selectedIdx int
-
+// setWeight sets the weight of name, resetting its effective weight only
+// if the weight changed. Callers must hold d.mu.
+func (d *MultiServerDiscovery) setWeight(name string, w int) {
 	for idx, value := range d.servers {
-		totalWeight += d.effectiveWeights[idx]
-		d.currentWeights[idx] += d.effectiveWeights[idx]
-
-		if selected == "" || d.currentWeights[idx] > d.currentWeights[selectedIdx] {
-			selected = value
-			selectedIdx = idx
+		if value == name && d.weights[idx] != w {
+			d.weights[idx] = w
+			d.effectiveWeights[idx] = min(w, d.maxWeight)
 		}
 	}
-	if selected == "" {
-		return "", errors.New("no available servers")
-	} 
-	d.currentWeights[selectedIdx] -= totalWeight
-	return selected, nil
-
 }
 
 func (d *MultiServerDiscovery) UpdateWeight(w int, name string) error {
@@ -193,8 +100,8 @@ func (d *MultiServerDiscovery) UpdateWeight(w int, name string) error {
 
 	for idx, value := range d.servers {
 		if value == name {
+			d.weights[idx] = w
 			d.effectiveWeights[idx] = w
-			d.currentWeights[idx] = 0
 			return nil
 		}
 	}
@@ -207,19 +114,22 @@ func (d *MultiServerDiscovery) MarkSuccess(name string) error {
 	defer d.mu.Unlock()
 	for idx, value := range d.servers {
 		if value == name {
-			d.currentWeights[idx] = min(d.maxWeight, d.currentWeights[idx] + 1)
+			d.effectiveWeights[idx] = min(d.maxWeight, d.weights[idx], d.effectiveWeights[idx] + 1)
 			return nil
 		}
 	}
 	return fmt.Errorf("rpc discovery: server %s not exist", name)
 }
 
+// MarkFailure lowers the effective weight of name. It never drops below 1
+// for a server with a positive weight, so that the server keeps being
+// picked now and then and can earn its weight back through MarkSuccess.
 func (d *MultiServerDiscovery) MarkFailure(name string) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 	for idx, value := range d.servers {
 		if value == name {
-			d.currentWeights[idx] = max(0, d.currentWeights[idx] - 1)
+			d.effectiveWeights[idx] = max(min(1, d.weights[idx]), d.effectiveWeights[idx] - 1)
 			return nil
 		}
 	}
@@ -233,30 +143,26 @@ func (d *MultiServerDiscovery) Refresh() error {
 func (d *MultiServerDiscovery) Update(servers []string) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
-	d.servers = servers
+	d.setServers(servers)
 	return nil
 }
 
-func (d *MultiServerDiscovery) Get(mode SelectMode) (string, error) {
-	d.mu.Lock()
-	defer d.mu.Unlock()
-	n := len(d.servers)
-	if n == 0 {
-		return "", errors.New("rpc discovery: no available servers")
+// setServers replaces the server list, keeping the weights of servers that
+// are still present. Callers must hold d.mu.
+func (d *MultiServerDiscovery) setServers(servers []string) {
+	weights := make(map[string][2]int, len(d.servers))
+	for idx, value := range d.servers {
+		weights[value] = [2]int{d.weights[idx], d.effectiveWeights[idx]}
 	}
-	switch mode {
-	case RandomSelect:
-		return d.servers[d.r.Intn(n)], nil
-	case RoundRobinSelect:
-		s := d.servers[d.index]
-		d.index = (d.index + 1) % n
-		return s, nil
-	case WeightRoundRobinSelect:
-		return d.Next()
-	case ConsistentHashSelect:
-		return d.consistentHash.Get(strconv.Itoa(d.r.Int()))
-	default:
-		return "", errors.New("rpc discovery: not supported select mode")
+	d.servers = servers
+	d.weights = make([]int, len(servers))
+	d.effectiveWeights = make([]int, len(servers))
+	for idx, value := range servers {
+		w, ok := weights[value]
+		if !ok {
+			w = [2]int{1, 1}
+		}
+		d.weights[idx], d.effectiveWeights[idx] = w[0], w[1]
 	}
 }
 
@@ -266,4 +172,4 @@ func (d *MultiServerDiscovery) GetAll() ([]string, error) {
 	servers := make([]string, len(d.servers))
 	copy(servers, d.servers)
 	return servers, nil
-}
\ No newline at end of file
+}
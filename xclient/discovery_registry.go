@@ -1,69 +1,255 @@
 package xclient
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"gorpc/registry"
 	"time"
 	"log"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 )
 
 type GoRegistryDiscovery struct {
 	*MultiServerDiscovery
 	registry string
+	token string
 	timeout time.Duration
 	lastUpdate time.Time
+	instances map[string]registry.Instance // metadata of every server seen, by address
+	watching bool // servers are pushed by the watcher, see StartWatch
+	stopWatch context.CancelFunc
 }
 
-const defaultUpdateTimeout = time.Second * 10
+const (
+	defaultUpdateTimeout = time.Second * 10
+	watchWait = time.Minute // how long a watch request blocks on the registry
+	watchRetry = time.Second
+	watchMaxRetry = time.Second * 30
+)
 
 func NewGoRegistryDiscovery(registerAddr string, timeout time.Duration) *GoRegistryDiscovery {
 	if timeout == 0 {
 		timeout = defaultUpdateTimeout
 	}
 	d := &GoRegistryDiscovery{
-		MultiServerDiscovery: NewMultiServerDiscovery(make([]string, 0), []int{2, 1}, 100, 50),
+		MultiServerDiscovery: NewMultiServerDiscovery(make([]string, 0), nil, 100, 0),
 		registry: registerAddr,
 		timeout: timeout,
+		instances: make(map[string]registry.Instance),
 	}
 	return d
 }
 
+// SetToken sets the bearer token sent with lookups to registries that
+// require one, see registry.GoRegistry.SetTokens. It must be called before
+// the discovery is used.
+func (d *GoRegistryDiscovery) SetToken(token string) {
+	d.token = token
+}
+
 func (d *GoRegistryDiscovery) Update(servers []string) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
-	d.servers = servers
-	d.lastUpdate = time.Now()
+	d.update(servers, nil)
 	return nil
 }
 
+// update sets the servers, recording the metadata of instances and
+// forgetting that of the servers gone. Callers must hold d.mu.
+func (d *GoRegistryDiscovery) update(servers []string, instances []registry.Instance) {
+	for _, inst := range instances {
+		d.instances[inst.Addr] = inst
+	}
+	d.setServers(servers)
+	present := make(map[string]bool, len(servers))
+	for _, addr := range servers {
+		present[addr] = true
+		d.setWeight(addr, instanceWeight(d.instances[addr]))
+	}
+	for addr := range d.instances {
+		if !present[addr] {
+			delete(d.instances, addr)
+		}
+	}
+	d.lastUpdate = time.Now()
+}
+
 func (d *GoRegistryDiscovery) Refresh() error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
-	if d.lastUpdate.Add(d.timeout).After(time.Now()) {
+	if d.watching || d.lastUpdate.Add(d.timeout).After(time.Now()) {
 		return nil
 	}
 	log.Println("rpc registry: refresh servers from registry", d.registry)
-	resp, err := http.Get(d.registry)
+	alive, instances, _, err := d.fetch(context.Background(), nil)
 	if err != nil {
-		log.Println("rpc registry refresh err:", err)
 		return err
 	}
+	d.update(alive, instances)
+	return nil
+}
+
+func instanceWeight(inst registry.Instance) int {
+	if inst.Weight <= 0 {
+		return 1
+	}
+	return inst.Weight
+}
+
+// Weight returns the weight of addr: its effective weight if it is one of
+// the servers of GetAll, the weight it registered with otherwise.
+func (d *GoRegistryDiscovery) Weight(addr string) int {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if w, ok := d.weight(addr); ok {
+		return w
+	}
+	return instanceWeight(d.instances[addr])
+}
+
+// Instance returns the metadata addr registered with, such as its zone and
+// labels, for custom balancers.
+func (d *GoRegistryDiscovery) Instance(addr string) (registry.Instance, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	inst, ok := d.instances[addr]
+	return inst, ok
+}
+
+// fetch looks up the servers on the registry, returning their addresses,
+// their metadata if the registry sent it and the index of the servers.
+func (d *GoRegistryDiscovery) fetch(ctx context.Context, query url.Values) ([]string, []registry.Instance, uint64, error) {
+	addr := d.registry
+	if len(query) > 0 {
+		addr += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", addr, nil)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	if d.token != "" {
+		req.Header.Set("Authorization", "Bearer "+d.token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Println("rpc registry refresh err:", err)
+		return nil, nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("rpc registry: unexpected status %s", resp.Status)
+		log.Println("rpc registry refresh err:", err)
+		return nil, nil, 0, err
+	}
+	index, _ := strconv.ParseUint(resp.Header.Get(registry.IndexHeader), 10, 64)
+	// registries predating instance metadata only send the header
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		var instances []registry.Instance
+		if err := json.NewDecoder(resp.Body).Decode(&instances); err != nil {
+			return nil, nil, 0, fmt.Errorf("rpc registry: invalid instances: %w", err)
+		}
+		alive := make([]string, len(instances))
+		for i, inst := range instances {
+			alive[i] = inst.Addr
+		}
+		return alive, instances, index, nil
+	}
 	servers := strings.Split(resp.Header.Get("X-GoRPC-Servers"), ",")
-	d.servers = make([]string, 0, len(servers))
+	alive := make([]string, 0, len(servers))
 	for _, server := range servers {
 		if strings.TrimSpace(server) != "" {
-			d.servers = append(d.servers, strings.TrimSpace(server))
+			alive = append(alive, strings.TrimSpace(server))
 		}
 	}
-	d.lastUpdate = time.Now()
-	return nil
+	return alive, nil, index, nil
+}
+
+// StartWatch starts watching the registry in the background: changes are
+// pushed to the discovery as they happen instead of being polled when
+// the servers are looked up. While the registry cannot be reached, lookups
+// fall back to polling. It must be called at most once.
+func (d *GoRegistryDiscovery) StartWatch() {
+	ctx, cancel := context.WithCancel(context.Background())
+	d.mu.Lock()
+	d.stopWatch = cancel
+	d.mu.Unlock()
+	go d.watch(ctx)
+}
+
+// StopWatch stops the watcher started by StartWatch.
+func (d *GoRegistryDiscovery) StopWatch() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.stopWatch != nil {
+		d.stopWatch()
+		d.stopWatch = nil
+	}
+	d.watching = false
+}
+
+func (d *GoRegistryDiscovery) watch(ctx context.Context) {
+	var index uint64
+	backoff := watchRetry
+	for {
+		query := url.Values{}
+		if index != 0 {
+			query.Set("index", strconv.FormatUint(index, 10))
+			query.Set("wait", watchWait.String())
+		}
+		alive, instances, next, err := d.fetch(ctx, query)
+		d.mu.Lock()
+		if ctx.Err() != nil {
+			d.mu.Unlock()
+			return
+		}
+		d.watching = err == nil && next != 0
+		if d.watching {
+			d.update(alive, instances)
+		}
+		d.mu.Unlock()
+		switch {
+		case err == nil && next != 0:
+			index = next
+			backoff = watchRetry
+			continue
+		case err == nil:
+			// the registry does not support watching
+			log.Println("rpc registry: watch not supported by", d.registry)
+			return
+		}
+		index = 0
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		backoff = min(2*backoff, watchMaxRetry)
+	}
 }
 
-func (d *GoRegistryDiscovery) Get(mode SelectMode) (string, error) {
+// GetService returns the servers of GetAll offering a version of service
+// that satisfies the constraint version, according to the services they
+// registered with. Servers whose metadata is unknown, such as those passed
+// to Update or listed by registries predating instance metadata, are
+// assumed to offer every service.
+func (d *GoRegistryDiscovery) GetService(service, version string) ([]string, error) {
 	if err := d.Refresh(); err != nil {
-		return "", err
+		return nil, err
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	servers := make([]string, 0, len(d.servers))
+	for _, addr := range d.servers {
+		inst, ok := d.instances[addr]
+		if !ok || inst.Offers(service, version) {
+			servers = append(servers, addr)
+		}
 	}
-	return d.MultiServerDiscovery.Get(mode)
+	return servers, nil
 }
 
 func (d *GoRegistryDiscovery) GetAll() ([]string, error) {
@@ -0,0 +1,183 @@
+package xclient
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"gorpc/client"
+	"gorpc/server"
+)
+
+// HealthCheckMethod is the service method probed by the health checker.
+const HealthCheckMethod = server.HealthService + ".Check"
+
+// ProbeFunc checks whether the server behind c is healthy.
+type ProbeFunc func(ctx context.Context, c *client.Client) error
+
+// HealthCheckConfig configures active health checking. Every Interval each
+// server of the discovery is probed; a server is marked unhealthy after
+// UnhealthyThreshold failed probes in a row and restored after
+// HealthyThreshold successful ones.
+type HealthCheckConfig struct {
+	Interval           time.Duration
+	Timeout            time.Duration
+	HealthyThreshold   int
+	UnhealthyThreshold int
+	Service            string    // service passed to Health.Check
+	Probe              ProbeFunc // defaults to calling HealthCheckMethod
+}
+
+var DefaultHealthCheckConfig = HealthCheckConfig{
+	Interval:           10 * time.Second,
+	Timeout:            time.Second,
+	HealthyThreshold:   2,
+	UnhealthyThreshold: 1,
+}
+
+type healthState struct {
+	unhealthy bool
+	successes int
+	failures  int
+}
+
+type healthChecker struct {
+	xc    *XClient
+	cfg   HealthCheckConfig
+	mu    sync.Mutex
+	state map[string]*healthState
+	stop  chan struct{}
+	once  sync.Once
+}
+
+func newHealthChecker(xc *XClient, cfg HealthCheckConfig) *healthChecker {
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultHealthCheckConfig.Interval
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultHealthCheckConfig.Timeout
+	}
+	if cfg.HealthyThreshold <= 0 {
+		cfg.HealthyThreshold = DefaultHealthCheckConfig.HealthyThreshold
+	}
+	if cfg.UnhealthyThreshold <= 0 {
+		cfg.UnhealthyThreshold = DefaultHealthCheckConfig.UnhealthyThreshold
+	}
+	if cfg.Probe == nil {
+		service := cfg.Service
+		cfg.Probe = func(ctx context.Context, c *client.Client) error {
+			var resp server.HealthCheckResponse
+			if err := c.Call(ctx, HealthCheckMethod, &server.HealthCheckRequest{Service: service}, &resp); err != nil {
+				return err
+			}
+			if resp.Status != server.Serving {
+				return fmt.Errorf("rpc xclient: health status %s", resp.Status)
+			}
+			return nil
+		}
+	}
+	return &healthChecker{
+		xc:    xc,
+		cfg:   cfg,
+		state: make(map[string]*healthState),
+		stop:  make(chan struct{}),
+	}
+}
+
+func (h *healthChecker) run() {
+	ticker := time.NewTicker(h.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		h.checkAll()
+		select {
+		case <-ticker.C:
+		case <-h.stop:
+			return
+		}
+	}
+}
+
+func (h *healthChecker) checkAll() {
+	servers, err := h.xc.d.GetAll()
+	if err != nil {
+		log.Println("rpc xclient: health check discovery err:", err)
+		return
+	}
+	var wg sync.WaitGroup
+	for _, rpcAddr := range servers {
+		wg.Add(1)
+		go func(rpcAddr string) {
+			defer wg.Done()
+			h.record(rpcAddr, h.probe(rpcAddr))
+		}(rpcAddr)
+	}
+	wg.Wait()
+
+	alive := make(map[string]bool, len(servers))
+	for _, rpcAddr := range servers {
+		alive[rpcAddr] = true
+	}
+	h.mu.Lock()
+	for rpcAddr := range h.state {
+		if !alive[rpcAddr] {
+			delete(h.state, rpcAddr)
+		}
+	}
+	h.mu.Unlock()
+}
+
+func (h *healthChecker) probe(rpcAddr string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), h.cfg.Timeout)
+	defer cancel()
+	c, err := h.xc.dialTimeout(rpcAddr, h.cfg.Timeout)
+	if err != nil {
+		return err
+	}
+	return h.cfg.Probe(ctx, c)
+}
+
+func (h *healthChecker) record(rpcAddr string, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.state[rpcAddr]
+	if !ok {
+		s = &healthState{}
+		h.state[rpcAddr] = s
+	}
+	if err != nil {
+		s.successes = 0
+		s.failures++
+		if !s.unhealthy && s.failures >= h.cfg.UnhealthyThreshold {
+			log.Printf("rpc xclient: %s is unhealthy: %v", rpcAddr, err)
+			s.unhealthy = true
+		}
+		return
+	}
+	s.failures = 0
+	s.successes++
+	if s.unhealthy && s.successes >= h.cfg.HealthyThreshold {
+		log.Printf("rpc xclient: %s is healthy again", rpcAddr)
+		s.unhealthy = false
+	}
+}
+
+// filter drops the unhealthy servers from servers. Servers that have not
+// been probed yet are considered healthy.
+func (h *healthChecker) filter(servers []string) []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	healthy := make([]string, 0, len(servers))
+	for _, rpcAddr := range servers {
+		if s, ok := h.state[rpcAddr]; ok && s.unhealthy {
+			continue
+		}
+		healthy = append(healthy, rpcAddr)
+	}
+	return healthy
+}
+
+func (h *healthChecker) close() {
+	h.once.Do(func() { close(h.stop) })
+}
@@ -0,0 +1,175 @@
+package xclient
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// OutlierConfig configures passive outlier detection. A server is ejected
+// after ConsecutiveFailures failed calls in a row, or when the EWMA of its
+// latency exceeds LatencyFactor times the median of all servers. Each
+// ejection lasts twice as long as the previous one, starting at
+// BaseEjectionTime and capped at MaxEjectionTime, and at most
+// MaxEjectionPercent of the servers are ejected at the same time.
+type OutlierConfig struct {
+	ConsecutiveFailures int     // 0 disables failure based ejection
+	LatencyFactor       float64 // 0 disables latency based ejection
+	MinRequests         int     // calls a server must have served before its latency is judged
+	BaseEjectionTime    time.Duration
+	MaxEjectionTime     time.Duration
+	MaxEjectionPercent  int
+}
+
+var DefaultOutlierConfig = OutlierConfig{
+	ConsecutiveFailures: 5,
+	LatencyFactor:       3,
+	MinRequests:         10,
+	BaseEjectionTime:    30 * time.Second,
+	MaxEjectionTime:     5 * time.Minute,
+	MaxEjectionPercent:  50,
+}
+
+type outlierStat struct {
+	consecutiveFailures int
+	requests            int
+	ewma                float64
+	ejections           int
+	ejectedUntil        time.Time
+}
+
+func (s *outlierStat) ejected(now time.Time) bool {
+	return now.Before(s.ejectedUntil)
+}
+
+type outlierDetector struct {
+	cfg   OutlierConfig
+	mu    sync.Mutex
+	stats map[string]*outlierStat
+	total int // number of servers of the discovery, see setTotal
+}
+
+func newOutlierDetector(cfg OutlierConfig) *outlierDetector {
+	if cfg.BaseEjectionTime <= 0 {
+		cfg.BaseEjectionTime = DefaultOutlierConfig.BaseEjectionTime
+	}
+	if cfg.MaxEjectionTime < cfg.BaseEjectionTime {
+		cfg.MaxEjectionTime = max(cfg.BaseEjectionTime, DefaultOutlierConfig.MaxEjectionTime)
+	}
+	if cfg.MaxEjectionPercent <= 0 {
+		cfg.MaxEjectionPercent = DefaultOutlierConfig.MaxEjectionPercent
+	}
+	return &outlierDetector{cfg: cfg, stats: make(map[string]*outlierStat)}
+}
+
+func (o *outlierDetector) stat(addr string) *outlierStat {
+	s, ok := o.stats[addr]
+	if !ok {
+		s = &outlierStat{}
+		o.stats[addr] = s
+	}
+	return s
+}
+
+// setTotal sets the number of servers of the discovery, against which
+// MaxEjectionPercent is applied. It is all of them, not only those offering
+// the service of a call.
+func (o *outlierDetector) setTotal(n int) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.total = n
+}
+
+// filter drops the ejected servers from servers. If every server is
+// ejected the list is returned unchanged.
+func (o *outlierDetector) filter(servers []string) []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	now := time.Now()
+	available := make([]string, 0, len(servers))
+	for _, addr := range servers {
+		if s, ok := o.stats[addr]; ok && s.ejected(now) {
+			continue
+		}
+		available = append(available, addr)
+	}
+	if len(available) == 0 {
+		return servers
+	}
+	return available
+}
+
+func (o *outlierDetector) report(addr string, latency time.Duration, err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	now := time.Now()
+	s := o.stat(addr)
+	s.requests++
+	if s.ewma == 0 {
+		s.ewma = float64(latency)
+	} else {
+		s.ewma = ewmaAlpha*float64(latency) + (1-ewmaAlpha)*s.ewma
+	}
+	if err != nil {
+		s.consecutiveFailures++
+		if o.cfg.ConsecutiveFailures > 0 && s.consecutiveFailures >= o.cfg.ConsecutiveFailures {
+			o.eject(s, now)
+		}
+		return
+	}
+	s.consecutiveFailures = 0
+	if s.ejections > 0 && now.Sub(s.ejectedUntil) > o.cfg.MaxEjectionTime {
+		s.ejections = 0
+	}
+	if o.cfg.LatencyFactor > 0 && o.slow(s) {
+		o.eject(s, now)
+	}
+}
+
+// slow reports whether the latency of s is abnormal compared to the median
+// of the servers with enough requests.
+func (o *outlierDetector) slow(s *outlierStat) bool {
+	if s.requests < o.cfg.MinRequests {
+		return false
+	}
+	var latencies []float64
+	for _, st := range o.stats {
+		if st.requests >= o.cfg.MinRequests {
+			latencies = append(latencies, st.ewma)
+		}
+	}
+	if len(latencies) < 2 {
+		return false
+	}
+	sort.Float64s(latencies)
+	median := latencies[len(latencies)/2]
+	if len(latencies)%2 == 0 {
+		median = (latencies[len(latencies)/2-1] + median) / 2
+	}
+	return s.ewma > o.cfg.LatencyFactor*median
+}
+
+func (o *outlierDetector) eject(s *outlierStat, now time.Time) {
+	if s.ejected(now) {
+		return
+	}
+	ejected := 0
+	for _, st := range o.stats {
+		if st.ejected(now) {
+			ejected++
+		}
+	}
+	if (ejected+1)*100 > o.total*o.cfg.MaxEjectionPercent {
+		return
+	}
+	d := o.cfg.BaseEjectionTime << s.ejections
+	if d > o.cfg.MaxEjectionTime || d <= 0 {
+		d = o.cfg.MaxEjectionTime
+	}
+	s.ejections++
+	s.ejectedUntil = now.Add(d)
+	s.consecutiveFailures = 0
+	// the latency that caused the ejection should not linger afterwards
+	s.requests = 0
+	s.ewma = 0
+}
@@ -0,0 +1,69 @@
+package xclient
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestOutlierDetector(t *testing.T) {
+	servers := []string{"tcp@a:1", "tcp@b:2", "tcp@c:3", "tcp@d:4"}
+	o := newOutlierDetector(OutlierConfig{
+		ConsecutiveFailures: 3,
+		BaseEjectionTime:    time.Minute,
+		MaxEjectionTime:     3 * time.Minute,
+		MaxEjectionPercent:  50,
+	})
+	o.setTotal(len(servers))
+	boom := errors.New("boom")
+
+	// 连续失败达到阈值后被剔除
+	for i := 0; i < 3; i++ {
+		o.report("tcp@a:1", time.Millisecond, boom)
+	}
+	available := o.filter(servers)
+	_assert(t, len(available) == 3 && available[0] == "tcp@b:2", "a not ejected: %v", available)
+
+	// 剔除时间指数增长并受上限约束
+	s := o.stats["tcp@a:1"]
+	first := time.Until(s.ejectedUntil)
+	_assert(t, first > 59*time.Second && first <= time.Minute, "unexpected ejection time %s", first)
+	for _, want := range []time.Duration{2 * time.Minute, 3 * time.Minute, 3 * time.Minute} {
+		s.ejectedUntil = time.Now()
+		for i := 0; i < 3; i++ {
+			o.report("tcp@a:1", time.Millisecond, boom)
+		}
+		got := time.Until(s.ejectedUntil)
+		_assert(t, got > want-time.Second && got <= want, "ejection time %s, want %s", got, want)
+	}
+
+	// 最多剔除50%的服务器，按setTotal设置的全部服务器数计算
+	for _, addr := range []string{"tcp@b:2", "tcp@c:3"} {
+		for i := 0; i < 3; i++ {
+			o.report(addr, time.Millisecond, boom)
+		}
+	}
+	available = o.filter(servers)
+	_assert(t, len(available) == 2, "ejected more than half of the servers: %v", available)
+
+	// 服务器总数增加后上限随之提高，与单次调用的服务器列表无关
+	o.setTotal(6)
+	for i := 0; i < 3; i++ {
+		o.report("tcp@c:3", time.Millisecond, boom)
+	}
+	available = o.filter(servers[2:])
+	_assert(t, len(available) == 1 && available[0] == "tcp@d:4", "c not ejected: %v", available)
+}
+
+func TestOutlierDetectorLatency(t *testing.T) {
+	servers := []string{"tcp@a:1", "tcp@b:2", "tcp@c:3"}
+	o := newOutlierDetector(OutlierConfig{LatencyFactor: 3, MinRequests: 5})
+	o.setTotal(len(servers))
+	for i := 0; i < 5; i++ {
+		o.report("tcp@a:1", time.Millisecond, nil)
+		o.report("tcp@b:2", time.Millisecond, nil)
+		o.report("tcp@c:3", 50*time.Millisecond, nil)
+	}
+	available := o.filter(servers)
+	_assert(t, len(available) == 2 && available[1] == "tcp@b:2", "slow server not ejected: %v", available)
+}
@@ -2,31 +2,115 @@ package xclient
 
 import (
 	"context"
+	"errors"
+	"math/rand"
 	"reflect"
 	"sync"
+	"time"
 	"gorpc/server"
 	"gorpc/client"
 	"log"
+	"strings"
 )
 
 type XClient struct {
 	d Discovery
-	mode SelectMode
+	b Balancer
 	opt *server.Option
+	keyFunc KeyFunc
+	outlier *outlierDetector
+	health *healthChecker
+	limiter *client.Limiter
+	creds client.Credentials
 	mu sync.Mutex
 	clients map[string]*client.Client
 }
 
+// Marker is implemented by discoveries that adjust servers on the outcome
+// of the calls sent to them.
+type Marker interface {
+	MarkSuccess(addr string) error
+	MarkFailure(addr string) error
+}
+
+// KeyFunc extracts the routing key of a call from its arguments.
+type KeyFunc func(serviceMethod string, args interface{}) string
+
+type hashKeyCtx struct{}
+
+// WithHashKey returns a copy of ctx carrying the routing key used by
+// the consistent hash balancer. Calls with the same key land on the same server.
+func WithHashKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, hashKeyCtx{}, key)
+}
+
 func NewXClient(d Discovery, mode SelectMode, opt *server.Option) *XClient {
+	w, _ := d.(Weigher)
+	var replicas int
+	if r, ok := d.(Replicator); ok {
+		replicas = r.Replicas()
+	}
+	return NewXClientWithBalancer(d, NewBalancer(mode, w, replicas), opt)
+}
+
+func NewXClientWithBalancer(d Discovery, b Balancer, opt *server.Option) *XClient {
 	return &XClient{
 		d: d,
-		mode: mode,
+		b: b,
 		opt: opt,
 		clients: make(map[string]*client.Client),
 	}
 }
 
+// SetKeyFunc sets the function used to derive the routing key of calls
+// whose context carries no key from WithHashKey. It must be called before
+// the client is used.
+func (xc *XClient) SetKeyFunc(f KeyFunc) {
+	xc.keyFunc = f
+}
+
+// SetOutlierDetection enables passive outlier detection: servers failing
+// or responding abnormally slowly are left out of selection for a while.
+// It must be called before the client is used.
+func (xc *XClient) SetOutlierDetection(cfg OutlierConfig) {
+	xc.outlier = newOutlierDetector(cfg)
+}
+
+// StartHealthCheck starts probing every server of the discovery in the
+// background. Unhealthy servers are never selected until they pass enough
+// probes again. It must be called at most once, before the client is used.
+func (xc *XClient) StartHealthCheck(cfg HealthCheckConfig) {
+	xc.health = newHealthChecker(xc, cfg)
+	go xc.health.run()
+}
+
+// SetLimits limits the calls sent through the client to all servers
+// together; every call of Broadcast and Fork counts. It must be called
+// before the client is used.
+func (xc *XClient) SetLimits(l client.Limits) {
+	xc.limiter = client.NewLimiter(l)
+}
+
+// SetCredentials makes every call, health probes included, send the
+// credentials of creds. It must be called before the client is used.
+func (xc *XClient) SetCredentials(creds client.Credentials) {
+	xc.creds = creds
+}
+
+func (xc *XClient) hashKey(ctx context.Context, serviceMethod string, args interface{}) string {
+	if key, ok := ctx.Value(hashKeyCtx{}).(string); ok {
+		return key
+	}
+	if xc.keyFunc != nil {
+		return xc.keyFunc(serviceMethod, args)
+	}
+	return ""
+}
+
 func (xc *XClient) Close() error {
+	if xc.health != nil {
+		xc.health.close()
+	}
 	xc.mu.Lock()
 	defer xc.mu.Unlock()
 	for key, client := range xc.clients {
@@ -37,26 +121,69 @@ func (xc *XClient) Close() error {
 }
 
 func (xc *XClient) dial(rpcAddr string) (*client.Client, error) {
+	return xc.dialTimeout(rpcAddr, 0)
+}
+
+// dialTimeout returns the client of rpcAddr, connecting within
+// connectTimeout, or the connect timeout of the option if it is 0. xc.mu
+// is not held while connecting, so that an unreachable server does not
+// hold up calls to the others.
+func (xc *XClient) dialTimeout(rpcAddr string, connectTimeout time.Duration) (*client.Client, error) {
 	xc.mu.Lock()
-	defer xc.mu.Unlock()
 	c, ok := xc.clients[rpcAddr]
 	if ok && !c.IsAvailable() {
 		_ = c.Close()
 		delete(xc.clients, rpcAddr)
 		c = nil
 	}
-	if c == nil {
-		var err error
-		c, err = client.XDial(rpcAddr, xc.opt)
-		if err != nil {
-			return nil, err
+	xc.mu.Unlock()
+	if c != nil {
+		return c, nil
+	}
+
+	opt := xc.opt
+	if connectTimeout > 0 {
+		o := *server.DefaultOption
+		if opt != nil {
+			o = *opt
 		}
-		xc.clients[rpcAddr] = c
+		o.ConnectTimeout = connectTimeout
+		opt = &o
+	}
+	c, err := client.XDial(rpcAddr, opt)
+	if err != nil {
+		return nil, err
 	}
+	if xc.creds != nil {
+		c.SetCredentials(xc.creds)
+	}
+
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	// another call may have connected in the meantime
+	if other, ok := xc.clients[rpcAddr]; ok && other.IsAvailable() {
+		_ = c.Close()
+		return other, nil
+	}
+	xc.clients[rpcAddr] = c
 	return c, nil
 }
 
-func (xc *XClient) call(rpcAddr string, ctx context.Context, serviceMethod string, args, reply interface{}) error {
+func (xc *XClient) call(rpcAddr string, ctx context.Context, serviceMethod string, args, reply interface{}) (err error) {
+	if xc.limiter != nil {
+		if err := xc.limiter.Acquire(ctx, serviceMethod); err != nil {
+			return err
+		}
+		defer xc.limiter.Release()
+	}
+	start := time.Now()
+	xc.b.Start(rpcAddr)
+	defer func() {
+		latency := time.Since(start)
+		failure := serverFailure(ctx, err)
+		xc.b.Done(rpcAddr, latency, failure)
+		xc.report(rpcAddr, latency, failure)
+	}()
 	client, err := xc.dial(rpcAddr)
 	if err != nil {
 		return err
@@ -64,8 +191,93 @@ func (xc *XClient) call(rpcAddr string, ctx context.Context, serviceMethod strin
 	return client.Call(ctx, serviceMethod, args, reply)
 }
 
+// serverFailure returns err as it counts against the server of the call.
+// Errors returned by the service itself do not, nor do calls rejected for
+// the caller's sake, such as rate limited or unauthorized ones: they give
+// nil. Calls abandoned by the caller give context.Canceled, as they say
+// nothing about the server.
+func serverFailure(ctx context.Context, err error) error {
+	if errors.Is(ctx.Err(), context.Canceled) {
+		return context.Canceled
+	}
+	var serverErr client.ServerError
+	if errors.As(err, &serverErr) || server.IsRateLimited(err) || server.IsPermissionDenied(err) {
+		return nil
+	}
+	return err
+}
+
+// report feeds the outcome of a call, filtered by serverFailure, to the
+// discovery and the outlier detector.
+func (xc *XClient) report(rpcAddr string, latency time.Duration, err error) {
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	if m, ok := xc.d.(Marker); ok {
+		if err != nil {
+			_ = m.MarkFailure(rpcAddr)
+		} else {
+			_ = m.MarkSuccess(rpcAddr)
+		}
+	}
+	if xc.outlier != nil {
+		xc.outlier.report(rpcAddr, latency, err)
+	}
+}
+
+// servers returns the servers of the discovery that are healthy and not
+// ejected. When the discovery is a ServiceDiscovery, only servers offering
+// the service called, in the version asked for by ctx if any, are returned.
+func (xc *XClient) servers(ctx context.Context, serviceMethod string) ([]string, error) {
+	var servers, all []string
+	var err error
+	if sd, ok := xc.d.(ServiceDiscovery); ok {
+		service := serviceMethod
+		if dot := strings.LastIndex(serviceMethod, "."); dot >= 0 {
+			service = serviceMethod[:dot]
+		}
+		servers, err = sd.GetService(service, client.VersionFromContext(ctx))
+		if _, prune := xc.b.(Pruner); err == nil && (xc.outlier != nil || prune) {
+			all, err = xc.d.GetAll()
+		}
+	} else {
+		servers, err = xc.d.GetAll()
+		all = servers
+	}
+	if err != nil {
+		return nil, err
+	}
+	if p, ok := xc.b.(Pruner); ok {
+		p.Prune(all)
+	}
+	if xc.health != nil {
+		servers = xc.health.filter(servers)
+	}
+	if xc.outlier != nil {
+		xc.outlier.setTotal(len(all))
+		servers = xc.outlier.filter(servers)
+	}
+	return servers, nil
+}
+
+func (xc *XClient) pick(ctx context.Context, serviceMethod string, args interface{}) (string, error) {
+	servers, err := xc.servers(ctx, serviceMethod)
+	if err != nil {
+		return "", err
+	}
+	if len(servers) == 0 {
+		return "", errors.New("rpc discovery: no available servers")
+	}
+	return xc.b.Pick(servers, &PickInfo{
+		Ctx: ctx,
+		ServiceMethod: serviceMethod,
+		Args: args,
+		Key: xc.hashKey(ctx, serviceMethod, args),
+	})
+}
+
 func (xc *XClient) Call(ctx context.Context, serviceMethod string, args, reply interface{}) error {
-	rpcAddr, err := xc.d.Get(xc.mode)
+	rpcAddr, err := xc.pick(ctx, serviceMethod, args)
 	log.Println("rpcAddr: ", rpcAddr)
 	if err != nil {
 		return err
@@ -74,7 +286,7 @@ func (xc *XClient) Call(ctx context.Context, serviceMethod string, args, reply i
 }
 
 func (xc *XClient) Broadcast(ctx context.Context, serviceMethod string, args, reply interface{}) error {
-	servers, err := xc.d.GetAll()
+	servers, err := xc.servers(ctx, serviceMethod)
 	if err != nil {
 		return err
 	}
@@ -83,6 +295,7 @@ func (xc *XClient) Broadcast(ctx context.Context, serviceMethod string, args, re
 	var e error
 	replyDone := reply == nil
 	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 	for _, rpcAddr := range servers {
 		wg.Add(1)
 		go func(rpcAddr string) {
@@ -106,4 +319,54 @@ func (xc *XClient) Broadcast(ctx context.Context, serviceMethod string, args, re
 	}
 	wg.Wait()
 	return e
-}
\ No newline at end of file
+}
+
+// Fork sends the call to k servers (all of them if k <= 0) and returns as
+// soon as one of them replies successfully, cancelling the others. An error
+// is returned only when every server fails.
+func (xc *XClient) Fork(ctx context.Context, k int, serviceMethod string, args, reply interface{}) error {
+	servers, err := xc.servers(ctx, serviceMethod)
+	if err != nil {
+		return err
+	}
+	if len(servers) == 0 {
+		return errors.New("rpc xclient: no available servers")
+	}
+	if k > 0 && k < len(servers) {
+		rand.Shuffle(len(servers), func(i, j int) {
+			servers[i], servers[j] = servers[j], servers[i]
+		})
+		servers = servers[:k]
+	}
+	type forkResult struct {
+		reply interface{}
+		err   error
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	ch := make(chan forkResult, len(servers))
+	for _, rpcAddr := range servers {
+		go func(rpcAddr string) {
+			var cloneReply interface{}
+			if reply != nil {
+				cloneReply = reflect.New(reflect.ValueOf(reply).Elem().Type()).Interface()
+			}
+			err := xc.call(rpcAddr, ctx, serviceMethod, args, cloneReply)
+			ch <- forkResult{cloneReply, err}
+		}(rpcAddr)
+	}
+	var e error
+	for range servers {
+		r := <-ch
+		if r.err == nil {
+			if reply != nil {
+				reflect.ValueOf(reply).Elem().Set(reflect.ValueOf(r.reply).Elem())
+			}
+			return nil
+		}
+		if e == nil {
+			e = r.err
+		}
+	}
+	return e
+}
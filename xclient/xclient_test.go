@@ -0,0 +1,317 @@
+package xclient
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"gorpc/client"
+	"gorpc/registry"
+	"gorpc/server"
+)
+
+type Bar int
+
+type Args struct{ Num1, Num2 int }
+
+func (b *Bar) Sum(args Args, reply *int) error {
+	if *b < 0 {
+		return errors.New("bar: broken")
+	}
+	time.Sleep(time.Duration(*b) * time.Millisecond)
+	*reply = args.Num1 + args.Num2
+	return nil
+}
+
+func _assert(t *testing.T, condition bool, msg string, v ...interface{}) {
+	t.Helper()
+	if !condition {
+		t.Errorf("assertion failed: "+msg, v...)
+	}
+}
+
+// 启动一个注册了Bar服务的服务器，delay<0表示调用总是失败
+func startBar(t *testing.T, delay int) string {
+	t.Helper()
+	s := server.NewServer()
+	b := Bar(delay)
+	if err := s.Register(&b); err != nil {
+		t.Fatalf("register error: %v", err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("network error: %v", err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	go s.Accept(l)
+	return "tcp@" + l.Addr().String()
+}
+
+func TestFork(t *testing.T) {
+	broken := startBar(t, -1)
+	slow := startBar(t, 500)
+	fast := startBar(t, 0)
+
+	d := NewMultiServerDiscovery([]string{broken, slow, fast}, []int{1, 1, 1}, 100, 50)
+	xc := NewXClient(d, RandomSelect, nil)
+	defer func() { _ = xc.Close() }()
+
+	var reply int
+	start := time.Now()
+	err := xc.Fork(context.Background(), 0, "Bar.Sum", &Args{Num1: 1, Num2: 2}, &reply)
+	_assert(t, err == nil, "fork error: %v", err)
+	_assert(t, reply == 3, "unexpected reply: %d", reply)
+	_assert(t, time.Since(start) < 500*time.Millisecond, "fork waited for the slow server")
+
+	// 所有服务器都失败时返回错误
+	d = NewMultiServerDiscovery([]string{broken}, []int{1}, 100, 50)
+	xc2 := NewXClient(d, RandomSelect, nil)
+	defer func() { _ = xc2.Close() }()
+	err = xc2.Fork(context.Background(), 0, "Bar.Sum", &Args{Num1: 1, Num2: 2}, &reply)
+	_assert(t, err != nil, "expected error when every server fails")
+}
+
+func startHealth(t *testing.T) (*server.Server, string) {
+	t.Helper()
+	s := server.NewServer()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("network error: %v", err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	go s.Accept(l)
+	return s, "tcp@" + l.Addr().String()
+}
+
+func TestHealthCheck(t *testing.T) {
+	_, goodAddr := startHealth(t)
+	bad, badAddr := startHealth(t)
+	bad.Health().SetServingStatus("", server.NotServing)
+
+	d := NewMultiServerDiscovery([]string{goodAddr, badAddr}, []int{1, 1}, 100, 50)
+	xc := NewXClient(d, RoundRobinSelect, nil)
+	defer func() { _ = xc.Close() }()
+	xc.StartHealthCheck(HealthCheckConfig{Interval: 50 * time.Millisecond, HealthyThreshold: 2})
+	time.Sleep(100 * time.Millisecond)
+
+	// 不健康的节点不会被选中
+	for i := 0; i < 10; i++ {
+		addr, err := xc.pick(context.Background(), "Health.Check", nil)
+		_assert(t, err == nil, "pick error: %v", err)
+		_assert(t, addr == goodAddr, "unhealthy server selected: %s", addr)
+	}
+
+	// 连续探测成功后恢复
+	bad.Health().SetServingStatus("", server.Serving)
+	time.Sleep(200 * time.Millisecond)
+	seen := make(map[string]bool)
+	for i := 0; i < 10; i++ {
+		addr, _ := xc.pick(context.Background(), "Health.Check", nil)
+		seen[addr] = true
+	}
+	_assert(t, seen[badAddr], "recovered server never selected")
+}
+
+func TestHealthCheckUnreachable(t *testing.T) {
+	// 接受连接却从不响应HTTP CONNECT的服务器，连接会一直阻塞
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("network error: %v", err)
+	}
+	defer func() { _ = l.Close() }()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	silent := "http@" + l.Addr().String()
+	good := startBar(t, 0)
+
+	d := NewMultiServerDiscovery([]string{silent, good}, []int{1, 1}, 100, 50)
+	xc := NewXClient(d, RoundRobinSelect, nil)
+	defer func() { _ = xc.Close() }()
+	xc.StartHealthCheck(HealthCheckConfig{Interval: time.Hour, Timeout: 100 * time.Millisecond})
+	time.Sleep(20 * time.Millisecond)
+
+	// 探测连接不可达的服务器时，不阻塞对其他服务器的调用
+	start := time.Now()
+	var reply int
+	err = xc.call(good, context.Background(), "Bar.Sum", &Args{Num1: 1, Num2: 2}, &reply)
+	_assert(t, err == nil && reply == 3, "call: %d, %v", reply, err)
+	_assert(t, time.Since(start) < 500*time.Millisecond, "call blocked for %v", time.Since(start))
+
+	// 连接受探测超时限制
+	time.Sleep(200 * time.Millisecond)
+	for i := 0; i < 4; i++ {
+		addr, err := xc.pick(context.Background(), "Bar.Sum", nil)
+		_assert(t, err == nil && addr == good, "pick: %s, %v", addr, err)
+	}
+}
+
+type BarV2 int
+
+func (b *BarV2) Sum(args Args, reply *int) error {
+	*reply = (args.Num1 + args.Num2) * 2
+	return nil
+}
+
+func TestVersionRouting(t *testing.T) {
+	r := registry.NewGoRegistry(time.Minute)
+	r.SetTokens("write", "read")
+	reg := httptest.NewServer(r)
+	defer reg.Close()
+
+	v1 := startBar(t, 0)
+	s := server.NewServer()
+	var b BarV2
+	if err := s.RegisterVersion("Bar", "2.1.0", &b); err != nil {
+		t.Fatalf("register error: %v", err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("network error: %v", err)
+	}
+	defer func() { _ = l.Close() }()
+	go s.Accept(l)
+	v2 := "tcp@" + l.Addr().String()
+	registry.HeartBeatWithToken(reg.URL, "write", v1, time.Minute, "Bar@1.0.0")
+	registry.HeartBeatWithToken(reg.URL, "write", v2, time.Minute, "Bar@2.1.0")
+
+	d := NewGoRegistryDiscovery(reg.URL, 0)
+	d.SetToken("read")
+	xc := NewXClient(d, RoundRobinSelect, nil)
+	defer func() { _ = xc.Close() }()
+
+	// 只路由到提供匹配版本的服务器
+	ctx := client.WithVersion(context.Background(), "^2")
+	for i := 0; i < 4; i++ {
+		var reply int
+		err := xc.Call(ctx, "Bar.Sum", &Args{Num1: 1, Num2: 2}, &reply)
+		_assert(t, err == nil && reply == 6, "call ^2: %d, %v", reply, err)
+	}
+	ctx = client.WithVersion(context.Background(), "1.x")
+	for i := 0; i < 4; i++ {
+		addr, err := xc.pick(ctx, "Bar.Sum", nil)
+		_assert(t, err == nil && addr == v1, "pick 1.x: %s, %v", addr, err)
+	}
+	_, err = xc.pick(client.WithVersion(context.Background(), "^3"), "Bar.Sum", nil)
+	_assert(t, err != nil, "expected no servers for ^3")
+}
+
+func TestXClientLimits(t *testing.T) {
+	addr1 := startBar(t, 100)
+	addr2 := startBar(t, 100)
+	d := NewMultiServerDiscovery([]string{addr1, addr2}, []int{1, 1}, 100, 50)
+	xc := NewXClient(d, RoundRobinSelect, nil)
+	defer func() { _ = xc.Close() }()
+	xc.SetLimits(client.Limits{MaxPending: 1, FailFast: true})
+
+	// 上限作用于所有服务器之和
+	done := make(chan error, 1)
+	go func() {
+		var reply int
+		done <- xc.Call(context.Background(), "Bar.Sum", &Args{Num1: 1, Num2: 2}, &reply)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	var reply int
+	err := xc.Call(context.Background(), "Bar.Sum", &Args{Num1: 1, Num2: 2}, &reply)
+	_assert(t, server.IsResourceExhausted(err), "expected resource exhausted, got %v", err)
+	_assert(t, <-done == nil, "first call failed")
+	err = xc.Call(context.Background(), "Bar.Sum", &Args{Num1: 1, Num2: 2}, &reply)
+	_assert(t, err == nil && reply == 3, "call after release: %d, %v", reply, err)
+}
+
+func TestRegistryWeights(t *testing.T) {
+	reg := httptest.NewServer(registry.NewGoRegistry(time.Minute))
+	defer reg.Close()
+	registry.HeartBeatInstance(reg.URL, "", registry.Instance{Addr: "tcp@a:1", Weight: 3}, time.Minute)
+	registry.HeartBeatInstance(reg.URL, "", registry.Instance{Addr: "tcp@b:1", Zone: "z2"}, time.Minute)
+
+	d := NewGoRegistryDiscovery(reg.URL, 0)
+	xc := NewXClient(d, WeightRoundRobinSelect, nil)
+	defer func() { _ = xc.Close() }()
+
+	// 注册中心中的权重用于加权轮询，未设置权重时为1
+	counts := make(map[string]int)
+	for i := 0; i < 8; i++ {
+		addr, err := xc.pick(context.Background(), "Bar.Sum", nil)
+		_assert(t, err == nil, "pick error: %v", err)
+		counts[addr]++
+	}
+	_assert(t, counts["tcp@a:1"] == 6 && counts["tcp@b:1"] == 2, "unexpected distribution: %v", counts)
+	inst, ok := d.Instance("tcp@b:1")
+	_assert(t, ok && inst.Zone == "z2", "unexpected instance %+v", inst)
+}
+
+func TestServiceRouting(t *testing.T) {
+	reg := httptest.NewServer(registry.NewGoRegistry(time.Minute))
+	defer reg.Close()
+
+	s := server.NewServer()
+	b := Bar(0)
+	if err := s.RegisterName("Qux", &b); err != nil {
+		t.Fatalf("register error: %v", err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("network error: %v", err)
+	}
+	defer func() { _ = l.Close() }()
+	go s.Accept(l)
+	qux := "tcp@" + l.Addr().String()
+	bar := startBar(t, 0)
+	registry.HeartBeatServer(reg.URL, "", s, registry.Instance{Addr: qux}, time.Minute)
+	registry.HeartBeat(reg.URL, bar, time.Minute, "Bar")
+
+	d := NewGoRegistryDiscovery(reg.URL, 0)
+	xc := NewXClient(d, RoundRobinSelect, nil)
+	defer func() { _ = xc.Close() }()
+
+	// 不带版本的调用也只路由到提供该服务的服务器
+	for i := 0; i < 4; i++ {
+		var reply int
+		err := xc.Call(context.Background(), "Bar.Sum", &Args{Num1: 1, Num2: 2}, &reply)
+		_assert(t, err == nil && reply == 3, "call Bar: %d, %v", reply, err)
+		err = xc.Call(context.Background(), "Qux.Sum", &Args{Num1: 1, Num2: 2}, &reply)
+		_assert(t, err == nil && reply == 3, "call Qux: %d, %v", reply, err)
+	}
+	_, err = xc.pick(context.Background(), "Baz.Sum", nil)
+	_assert(t, err != nil, "expected no servers for Baz")
+}
+
+func TestRegistryWatch(t *testing.T) {
+	reg := httptest.NewServer(registry.NewGoRegistry(time.Minute))
+	defer reg.Close()
+	registry.HeartBeat(reg.URL, "tcp@a:1", time.Minute)
+
+	d := NewGoRegistryDiscovery(reg.URL, time.Hour)
+	d.StartWatch()
+	defer d.StopWatch()
+	servers := func() string {
+		all, _ := d.GetAll()
+		return strings.Join(all, ",")
+	}
+	waitFor := func(want string) {
+		t.Helper()
+		for i := 0; i < 100 && servers() != want; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		_assert(t, servers() == want, "servers %q, want %q", servers(), want)
+	}
+	waitFor("tcp@a:1")
+
+	// 变化被推送过来，无需等待轮询超时
+	registry.HeartBeatInstance(reg.URL, "", registry.Instance{Addr: "tcp@b:1", Weight: 4}, time.Minute)
+	waitFor("tcp@a:1,tcp@b:1")
+	_assert(t, d.Weight("tcp@b:1") == 4, "weight not pushed: %d", d.Weight("tcp@b:1"))
+	_ = registry.Deregister(reg.URL, "tcp@a:1")
+	waitFor("tcp@b:1")
+}